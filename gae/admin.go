@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/image"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// adminPageSize is how many gophers the admin list shows at a time.
+	adminPageSize = 50
+	// maxDeleteBatch is the most entities deleted in one call.
+	maxDeleteBatch = 500
+)
+
+// adminMessages are the messages admin pages show after an action,
+// chosen with the done parameter.
+var adminMessages = map[string]string{
+	"hidden":    "The gopher is hidden from the public feeds.",
+	"shown":     "The gopher is back in the public feeds.",
+	"deleted":   "The gopher and its image have been deleted.",
+	"refreshed": "The catalog has been refreshed.",
+	"purged":    "The render caches have been purged.",
+}
+
+// errRostersNotIndexed is returned for gopher deletes before the
+// roster-gophers backfill has finished, as the rosters using the gopher
+// can't be found yet.
+var errRostersNotIndexed = errors.New("gophers can't be deleted until the roster-gophers backfill has finished")
+
+// errBadCursor is returned for cursors that aren't from a previous
+// page.
+var errBadCursor = errors.New("bad cursor")
+
+// findGophers gets a page of gophers for the admin list, newest first.
+// search is a gopher ID, an owner's email address or an artwork item ID;
+// empty lists them all. hiddenOnly lists just the hidden ones.
+func findGophers(ctx context.Context, search string, hiddenOnly bool, cursor string) ([]Gopher, string, error) {
+	if server.IsGopherHash(search) {
+		var gopher Gopher
+		err := datastore.Get(ctx, datastore.NewKey(ctx, gopherKind, search, 0, nil), &gopher)
+		if err == datastore.ErrNoSuchEntity {
+			return nil, "", nil
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "load Gopher")
+		}
+		gopher.ID = search
+		return []Gopher{gopher}, "", nil
+	}
+	query := datastore.NewQuery(gopherKind).Order("-CTime").Limit(adminPageSize)
+	switch {
+	case search == "":
+		if hiddenOnly {
+			query = query.Filter("Hidden =", true)
+		}
+	case strings.Contains(search, "@"):
+		keys, err := datastore.NewQuery(userKind).Filter("Email =", search).KeysOnly().Limit(1).GetAll(ctx, nil)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "find User")
+		}
+		if len(keys) == 0 {
+			return nil, "", nil
+		}
+		query = query.Filter("Owner =", keys[0].StringID())
+	default:
+		query = query.Filter("Images =", search)
+	}
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", errBadCursor
+		}
+		query = query.Start(c)
+	}
+	var gophers []Gopher
+	it := query.Run(ctx)
+	n := 0
+	for {
+		var gopher Gopher
+		key, err := it.Next(&gopher)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "load gophers")
+		}
+		n++
+		if hiddenOnly && !gopher.Hidden {
+			continue
+		}
+		gopher.ID = key.StringID()
+		gophers = append(gophers, gopher)
+	}
+	if n < adminPageSize {
+		return gophers, "", nil
+	}
+	// a full page means there may be more
+	next, err := it.Cursor()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "cursor")
+	}
+	return gophers, next.String(), nil
+}
+
+// setGopherHidden hides the gopher from the public feeds, or shows it
+// again.
+func setGopherHidden(ctx context.Context, gopherHash string, hidden bool) error {
+	key := datastore.NewKey(ctx, gopherKind, gopherHash, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var gopher Gopher
+		if err := datastore.Get(ctx, key, &gopher); err != nil {
+			return err
+		}
+		gopher.Hidden = hidden
+		_, err := datastore.Put(ctx, key, &gopher)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return err
+	}
+	return errors.Wrap(err, "moderate Gopher")
+}
+
+// deleteGopher deletes the gopher's image, its serving URLs, its view,
+// download and save counts, the Gopher and its SaveJob, and takes it out
+// of every collection and roster. The Gopher goes last, so a failed
+// delete can be tried again.
+func deleteGopher(ctx context.Context, gopherHash string) error {
+	key := datastore.NewKey(ctx, gopherKind, gopherHash, 0, nil)
+	var gopher Gopher
+	if err := datastore.Get(ctx, key, &gopher); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return err
+		}
+		return errors.Wrap(err, "load Gopher")
+	}
+	// find the rosters first, so nothing is deleted if they can't be
+	rosters, err := rostersWithGopher(ctx, gopherHash)
+	if err != nil {
+		return err
+	}
+	bucket, err := file.DefaultBucketName(ctx)
+	if err != nil {
+		return errors.Wrap(err, "DefaultBucketName")
+	}
+	objpath := server.GopherObject(gopherHash)
+	blobkey, err := blobstore.BlobKeyForFile(ctx, fmt.Sprintf("/gs/%s/%s", bucket, objpath))
+	if err != nil {
+		return errors.Wrap(err, "BlobKeyForFile")
+	}
+	if err := image.DeleteServingURL(ctx, blobkey); err != nil {
+		// the object may have gone already
+		log.Warningf(ctx, "DeleteServingURL %s: %s", objpath, err)
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "storage.NewClient")
+	}
+	err = client.Bucket(bucket).Object(objpath).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return errors.Wrap(err, "delete gopher image")
+	}
+	saved, err := savedGopherKeys(ctx, gopherHash)
+	if err != nil {
+		return err
+	}
+	for len(saved) > 0 {
+		n := len(saved)
+		if n > maxDeleteBatch {
+			n = maxDeleteBatch
+		}
+		if err := datastore.DeleteMulti(ctx, saved[:n]); err != nil {
+			return errors.Wrap(err, "delete SavedGophers")
+		}
+		saved = saved[n:]
+	}
+	for _, rosterKey := range rosters {
+		if err := removeRosterGopher(ctx, rosterKey, gopherHash); err != nil {
+			return err
+		}
+	}
+	// so it drops out of the popular gophers
+	for _, group := range []string{server.CounterGopherViews, server.CounterGopherDownloads, server.CounterGopherSaves} {
+		if err := server.DeleteCount(ctx, group, gopherHash); err != nil {
+			return err
+		}
+	}
+	keys := []*datastore.Key{
+		key,
+		datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil),
+	}
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := datastore.Get(ctx, key, &Gopher{}); err != nil {
+			return err
+		}
+		if err := datastore.DeleteMulti(ctx, keys); err != nil {
+			return err
+		}
+		return countGopher(ctx, gopher.CTime, -1)
+	}, &datastore.TransactionOptions{XG: true})
+	if err == datastore.ErrNoSuchEntity {
+		// deleted by someone else in the meantime
+		return nil
+	}
+	return errors.Wrap(err, "delete Gopher")
+}
+
+// adminReturn gets where to send admins after an action: the return
+// form value if it is an admin page, otherwise fallback. done picks one
+// of the adminMessages.
+func adminReturn(r *http.Request, fallback, done string) string {
+	u, err := url.Parse(r.FormValue("return"))
+	if err != nil || u.IsAbs() || u.Host != "" || (u.Path != "/admin" && !strings.HasPrefix(u.Path, "/admin/")) {
+		u, _ = url.Parse(fallback)
+	}
+	q := u.Query()
+	q.Set("done", done)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// requireAdminPost checks an admin action is a POST from an admin page.
+func requireAdminPost(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	ctx := appengine.NewContext(r)
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	user, ok := requireAdmin(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !checkCSRF(ctx, r) {
+		http.Error(w, "this page has expired - please reload it and try again", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// handleAdmin lists saved gophers for admins, with the q, hidden and
+// cursor parameters described by findGophers.
+func handleAdmin() http.Handler {
+	tpl, err := template.ParseFiles("pages/_layout.html", "pages/admin.html")
+	if err != nil {
+		return server.ErrHandler(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		token, err := csrfToken(ctx, w, r)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q := r.URL.Query()
+		search := strings.TrimSpace(q.Get("q"))
+		hiddenOnly := q.Get("hidden") == "true"
+		gophers, next, err := findGophers(ctx, search, hiddenOnly, q.Get("cursor"))
+		if err == errBadCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var nextURL string
+		if next != "" {
+			nq := url.Values{"cursor": {next}}
+			if search != "" {
+				nq.Set("q", search)
+			}
+			if hiddenOnly {
+				nq.Set("hidden", "true")
+			}
+			nextURL = "/admin?" + nq.Encode()
+		}
+		pageInfo := struct {
+			PageURL     string
+			CacheBuster string
+			User        *User
+			CSRFToken   string
+			Message     string
+			Search      string
+			HiddenOnly  bool
+			Gophers     []Gopher
+			NextURL     string
+			Return      string
+		}{
+			PageURL:     "https://gopherize.me/admin",
+			CacheBuster: appengine.VersionID(ctx),
+			User:        user,
+			CSRFToken:   token,
+			Message:     adminMessages[q.Get("done")],
+			Search:      search,
+			HiddenOnly:  hiddenOnly,
+			Gophers:     gophers,
+			NextURL:     nextURL,
+			Return:      r.URL.RequestURI(),
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "private, no-store")
+		if err := tpl.ExecuteTemplate(w, "layout", pageInfo); err != nil {
+			log.Errorf(ctx, "template execute: %s", err)
+			server.ErrHandler(err).ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleAdminGopher hides, shows or deletes a gopher with the action
+// form value hide, show or delete.
+func handleAdminGopher() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireAdminPost(w, r)
+		if !ok {
+			return
+		}
+		gopherHash := mux.Vars(r)["gopherhash"]
+		var err error
+		var done string
+		switch action := r.FormValue("action"); action {
+		case "hide", "show":
+			err = setGopherHidden(ctx, gopherHash, action == "hide")
+			done = map[string]string{"hide": "hidden", "show": "shown"}[action]
+		case "delete":
+			err = deleteGopher(ctx, gopherHash)
+			done = "deleted"
+		default:
+			http.Error(w, "action must be hide, show or delete", http.StatusBadRequest)
+			return
+		}
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err == errRostersNotIndexed {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s %s gopher %s", user.Email, done, gopherHash)
+		http.Redirect(w, r, adminReturn(r, "/admin", done), http.StatusSeeOther)
+	})
+}
+
+// handleAdminCatalog shows the version of each pack's catalog, in the
+// bucket and in the cache, and what breaks the artwork rules.
+func handleAdminCatalog() http.Handler {
+	tpl, err := template.ParseFiles("pages/_layout.html", "pages/admin_catalog.html")
+	if err != nil {
+		return server.ErrHandler(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		token, err := csrfToken(ctx, w, r)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		packs, err := server.Packs(ctx)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		reports := make([]server.CatalogReport, len(packs))
+		for i, pack := range packs {
+			if reports[i], err = server.CheckCatalog(ctx, pack); err != nil {
+				err = errors.Wrapf(err, "check pack %q", pack)
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		pageInfo := struct {
+			PageURL     string
+			CacheBuster string
+			User        *User
+			CSRFToken   string
+			Message     string
+			Reports     []server.CatalogReport
+		}{
+			PageURL:     "https://gopherize.me/admin/catalog",
+			CacheBuster: appengine.VersionID(ctx),
+			User:        user,
+			CSRFToken:   token,
+			Message:     adminMessages[r.URL.Query().Get("done")],
+			Reports:     reports,
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "private, no-store")
+		if err := tpl.ExecuteTemplate(w, "layout", pageInfo); err != nil {
+			log.Errorf(ctx, "template execute: %s", err)
+			server.ErrHandler(err).ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleAdminRefresh rebuilds the cached catalog of the pack form
+// value.
+func handleAdminRefresh() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireAdminPost(w, r)
+		if !ok {
+			return
+		}
+		pack := r.FormValue("pack")
+		if err := server.CheckPack(pack); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := server.RefreshPack(ctx, pack); err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s refreshed the catalog of pack %q", user.Email, pack)
+		http.Redirect(w, r, adminReturn(r, "/admin/catalog", "refreshed"), http.StatusSeeOther)
+	})
+}
+
+// handleAdminPurgeRenders purges every cached render and sheet.
+func handleAdminPurgeRenders() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireAdminPost(w, r)
+		if !ok {
+			return
+		}
+		generation, err := server.PurgeRenders(ctx)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s purged the render caches, starting generation %s", user.Email, generation)
+		http.Redirect(w, r, adminReturn(r, "/admin/catalog", "purged"), http.StatusSeeOther)
+	})
+}
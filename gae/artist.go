@@ -0,0 +1,619 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Groups a User may be in.
+const (
+	groupArtists = "artists"
+	groupAdmins  = "admins"
+)
+
+// maxUploadSize is the biggest artwork upload request.
+const maxUploadSize = 6 << 20
+
+func (u *User) inGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// userInGroups reports whether the signed in User is in one of the
+// groups, for private artwork packs. Admins are in them all.
+func userInGroups(r *http.Request, groups []string) bool {
+	ctx := appengine.NewContext(r)
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		log.Warningf(ctx, "%s", err)
+		return false
+	}
+	if user == nil {
+		return false
+	}
+	if user.inGroup(groupAdmins) {
+		return true
+	}
+	for _, group := range groups {
+		if user.inGroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireArtist gets the signed in User if they may manage artwork.
+func requireArtist(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !user.inGroup(groupArtists) && !user.inGroup(groupAdmins) {
+		http.Error(w, "only artists may manage artwork", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// requireAdmin gets the signed in User if they are an admin.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, ok := requireUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !user.inGroup(groupAdmins) {
+		http.Error(w, "only admins may do that", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// handleUploadArtwork adds an artwork item from a multipart form with
+// the category, name and file, and optionally position (for a new
+// category), variant (2 or 4), artist and license.
+func handleUploadArtwork() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireArtist(w, r)
+		if !ok {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "file").Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		upload := server.ArtworkUpload{
+			Category: r.FormValue("category"),
+			Name:     r.FormValue("name"),
+			Artist:   r.FormValue("artist"),
+			License:  r.FormValue("license"),
+		}
+		if upload.Artist == "" {
+			upload.Artist = user.Name
+		}
+		if upload.Position, err = intFormValue(r, "position", 999); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if upload.Variant, err = intFormValue(r, "variant", 0); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if upload.Data, err = ioutil.ReadAll(f); err != nil {
+			http.Error(w, errors.Wrap(err, "file").Error(), http.StatusBadRequest)
+			return
+		}
+		contentType, err := server.CheckArtwork(ctx, upload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := server.UploadArtwork(ctx, upload, contentType)
+		if err != nil {
+			respondArtworkErr(ctx, w, r, errors.Wrap(err, "upload artwork"))
+			return
+		}
+		log.Infof(ctx, "%s uploaded %s", user.Email, id)
+		respondArtwork(ctx, w, http.StatusCreated, id)
+	})
+}
+
+// handleArtworkItem changes an item with the form values state,
+// collection (empty to take it out of one), name and position, or
+// deletes it with delete or the DELETE method. Renaming or moving an
+// item changes its ID, so like deleting, it is only done to items used
+// by saved gophers with force.
+func handleArtworkItem() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireArtist(w, r)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		if r.Method == http.MethodDelete || r.FormValue("delete") != "" {
+			if !checkUnused(ctx, w, r, id) {
+				return
+			}
+			if err := server.DeleteArtwork(ctx, id); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "delete artwork"))
+				return
+			}
+			log.Infof(ctx, "%s deleted %s", user.Email, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		position, err := intFormValue(r, "position", -1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := r.FormValue("name")
+		if name != "" {
+			if err := server.CheckArtworkName(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if position != -1 {
+			if err := server.CheckPosition(position); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		state := r.FormValue("state")
+		if state != "" {
+			if err := server.CheckState(state); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if name != "" || position != -1 {
+			if !checkUnused(ctx, w, r, id) {
+				return
+			}
+		}
+		if state != "" {
+			if err := server.SetArtworkState(ctx, id, state); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "set artwork state"))
+				return
+			}
+		}
+		if collection, ok := r.Form["collection"]; ok {
+			if err := server.SetArtworkCollection(ctx, id, collection[0]); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "set artwork collection"))
+				return
+			}
+		}
+		if name != "" {
+			if id, err = server.RenameArtwork(ctx, id, name); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "rename artwork"))
+				return
+			}
+		}
+		if position != -1 {
+			if id, err = server.MoveArtwork(ctx, id, position); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "move artwork"))
+				return
+			}
+		}
+		log.Infof(ctx, "%s changed %s", user.Email, id)
+		respondArtwork(ctx, w, http.StatusOK, id)
+	})
+}
+
+// handleArtworkCategory changes every item in a category with the form
+// values state, collection, name and position, or deletes them all
+// with delete or the DELETE method. Categories with items used by
+// saved gophers are only renamed, moved or deleted with force.
+func handleArtworkCategory() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireArtist(w, r)
+		if !ok {
+			return
+		}
+		category := mux.Vars(r)["category"]
+		if r.Method == http.MethodDelete || r.FormValue("delete") != "" {
+			ids, err := categoryItems(ctx, category)
+			if err != nil {
+				respondArtworkErr(ctx, w, r, err)
+				return
+			}
+			if !checkUnused(ctx, w, r, ids...) {
+				return
+			}
+			if err := server.DeleteCategory(ctx, category); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "delete category"))
+				return
+			}
+			log.Infof(ctx, "%s deleted category %s", user.Email, category)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		position, err := intFormValue(r, "position", -1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := r.FormValue("name")
+		if name != "" {
+			if err := server.CheckCategoryName(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if position != -1 {
+			if err := server.CheckPosition(position); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		state := r.FormValue("state")
+		if state != "" {
+			if err := server.CheckState(state); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if (name != "" && name != category) || position != -1 {
+			ids, err := categoryItems(ctx, category)
+			if err != nil {
+				respondArtworkErr(ctx, w, r, err)
+				return
+			}
+			if !checkUnused(ctx, w, r, ids...) {
+				return
+			}
+		}
+		if state != "" {
+			if err := server.SetCategoryState(ctx, category, state); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "set category state"))
+				return
+			}
+		}
+		if collection, ok := r.Form["collection"]; ok {
+			if err := server.SetCategoryCollection(ctx, category, collection[0]); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "set category collection"))
+				return
+			}
+		}
+		if name != "" && name != category {
+			if err := server.RenameCategory(ctx, category, name); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "rename category"))
+				return
+			}
+			category = name
+		}
+		if position != -1 {
+			if err := server.MoveCategory(ctx, category, position); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "move category"))
+				return
+			}
+		}
+		log.Infof(ctx, "%s changed category %s", user.Email, category)
+		respondArtwork(ctx, w, http.StatusOK, category)
+	})
+}
+
+// categoryItems gets the IDs of the items in a category.
+func categoryItems(ctx context.Context, category string) ([]string, error) {
+	categories, err := server.AllArtwork(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load artwork")
+	}
+	var ids []string
+	for _, cat := range categories {
+		if cat.Name != category {
+			continue
+		}
+		for _, img := range cat.Images {
+			ids = append(ids, img.ID)
+		}
+	}
+	return ids, nil
+}
+
+// handleCollections lists the scheduled collections.
+func handleCollections() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if _, ok := requireArtist(w, r); !ok {
+			return
+		}
+		collections, err := server.Collections(ctx)
+		if err != nil {
+			err = errors.Wrap(err, "load collections")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if collections == nil {
+			collections = []server.Collection{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Collections []server.Collection `json:"collections"`
+		}{Collections: collections}); err != nil {
+			log.Errorf(ctx, "encode collections: %s", err)
+		}
+	})
+}
+
+// handleCollection schedules a collection from the form values start
+// and end (RFC 3339 times, either may be empty for no limit), or takes
+// it off the schedule with delete or the DELETE method.
+func handleCollection() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireArtist(w, r)
+		if !ok {
+			return
+		}
+		name := mux.Vars(r)["collection"]
+		if r.Method == http.MethodDelete || r.FormValue("delete") != "" {
+			if err := server.DeleteCollection(ctx, name); err != nil {
+				respondArtworkErr(ctx, w, r, errors.Wrap(err, "delete collection"))
+				return
+			}
+			log.Infof(ctx, "%s deleted collection %s", user.Email, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		c := server.Collection{Name: name}
+		var err error
+		if c.Start, err = timeFormValue(r, "start"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if c.End, err = timeFormValue(r, "end"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := server.CheckCollection(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := server.SetCollection(ctx, c); err != nil {
+			respondArtworkErr(ctx, w, r, errors.Wrap(err, "set collection"))
+			return
+		}
+		log.Infof(ctx, "%s scheduled collection %s", user.Email, name)
+		respondArtwork(ctx, w, http.StatusOK, name)
+	})
+}
+
+// handleArtworkPreview responds with the artwork the picker will show
+// at the RFC 3339 time in the at query parameter.
+func handleArtworkPreview() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireAdmin(w, r); !ok {
+			return
+		}
+		at, err := timeFormValue(r, "at")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if at.IsZero() {
+			at = time.Now()
+		}
+		server.ServeArtwork(w, r, at)
+	})
+}
+
+// handleRetiredArtwork lists the retired items and how many saved
+// gophers use each, most used first. The counts are null until every
+// gopher has been indexed by image.
+func handleRetiredArtwork() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if _, ok := requireArtist(w, r); !ok {
+			return
+		}
+		categories, err := server.AllArtwork(ctx)
+		if err != nil {
+			err = errors.Wrap(err, "load artwork")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		type retiredItem struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Category string `json:"category"`
+			Gophers  *int   `json:"gophers"`
+		}
+		items := []retiredItem{}
+		var ids []string
+		for _, cat := range categories {
+			for _, img := range cat.Images {
+				if img.State != server.StateRetired {
+					continue
+				}
+				items = append(items, retiredItem{
+					ID:       img.ID,
+					Name:     img.Name,
+					Category: cat.Name,
+				})
+				ids = append(ids, img.ID)
+			}
+		}
+		counted, err := backfillDone(ctx, backfillGopherImages)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if counted {
+			counts, err := countGophersUsing(ctx, ids...)
+			if err != nil {
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for i := range items {
+				items[i].Gophers = &counts[i]
+			}
+			sort.SliceStable(items, func(i, j int) bool {
+				return *items[i].Gophers > *items[j].Gophers
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Items []retiredItem `json:"items"`
+		}{Items: items}); err != nil {
+			log.Errorf(ctx, "encode retired artwork: %s", err)
+		}
+	})
+}
+
+// countConcurrency is how many gopher counts run at once.
+const countConcurrency = 10
+
+// countGophersUsing counts the saved gophers that include each item.
+// Gophers saved before Images was indexed aren't counted until the
+// gopher-images backfill has finished.
+func countGophersUsing(ctx context.Context, ids ...string) ([]int, error) {
+	counts := make([]int, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, countConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			counts[i], errs[i] = datastore.NewQuery(gopherKind).Filter("Images =", id).KeysOnly().Count(ctx)
+		}(i, id)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, errors.Wrap(err, "count gophers")
+		}
+	}
+	return counts, nil
+}
+
+// checkUnused responds with a conflict and returns false if saved
+// gophers use any of the items, or if that can't be known yet, unless
+// the force form value is set.
+func checkUnused(ctx context.Context, w http.ResponseWriter, r *http.Request, ids ...string) bool {
+	if r.FormValue("force") == "true" {
+		return true
+	}
+	done, err := backfillDone(ctx, backfillGopherImages)
+	if err != nil {
+		log.Errorf(ctx, "%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !done {
+		http.Error(w, "can't tell which saved gophers use the artwork until they have all been indexed - try again later, or delete with force=true", http.StatusConflict)
+		return false
+	}
+	counts, err := countGophersUsing(ctx, ids...)
+	if err != nil {
+		log.Errorf(ctx, "%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	for i, n := range counts {
+		if n > 0 {
+			http.Error(w, fmt.Sprintf("%s is used by %d saved gophers - retire it instead, or delete with force=true", ids[i], n), http.StatusConflict)
+			return false
+		}
+	}
+	return true
+}
+
+// timeFormValue gets the named form value as an RFC 3339 time, or the
+// zero time if it is missing.
+func timeFormValue(r *http.Request, name string) (time.Time, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("%s must be an RFC 3339 time, like 2017-12-01T00:00:00Z", name)
+	}
+	return t, nil
+}
+
+// intFormValue gets the named form value as an int, or def if it is
+// missing.
+func intFormValue(r *http.Request, name string, def int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Errorf("%s must be a number", name)
+	}
+	return n, nil
+}
+
+func respondArtwork(ctx context.Context, w http.ResponseWriter, status int, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(struct {
+		ID string `json:"id"`
+	}{ID: id}); err != nil {
+		log.Errorf(ctx, "encode artwork: %s", err)
+	}
+}
+
+func respondArtworkErr(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	switch errors.Cause(err) {
+	case server.ErrArtworkNotFound:
+		http.NotFound(w, r)
+	case server.ErrArtworkExists:
+		http.Error(w, errors.Cause(err).Error(), http.StatusConflict)
+	case server.ErrCollectionNotFound:
+		http.Error(w, errors.Cause(err).Error(), http.StatusNotFound)
+	default:
+		log.Errorf(ctx, "%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
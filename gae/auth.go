@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	userKind   = "User"
+	secretKind = "Secret"
+
+	sessionCookie  = "session"
+	stateCookie    = "auth_state"
+	sessionTimeout = 30 * 24 * time.Hour
+)
+
+// User is a signed in person.
+// Its key name is the provider name and the provider's subject ID
+// joined with a colon.
+type User struct {
+	ID     string    `datastore:"-" json:"id"`
+	Email  string    `json:"email"`
+	Name   string    `datastore:",noindex" json:"name"`
+	Groups []string  `json:"groups,omitempty"`
+	CTime  time.Time `json:"ctime"`
+}
+
+// account is the identity an authProvider vouches for.
+type account struct {
+	Subject string
+	Email   string
+	Name    string
+}
+
+// authProvider signs people in with OAuth.
+type authProvider interface {
+	// Name is the unique name of the provider.
+	Name() string
+	// LoginURL gets the URL to send people to sign in. The provider
+	// returns them to redirectURL with state and a code.
+	LoginURL(state, redirectURL string) string
+	// Exchange turns the code from the callback into an account.
+	Exchange(ctx context.Context, code, redirectURL string) (account, error)
+}
+
+// newAuthProvider gets the Google provider configured with the
+// OAUTH_CLIENT_ID and OAUTH_CLIENT_SECRET environment variables, or
+// the fake provider when running on the dev server without them.
+func newAuthProvider() authProvider {
+	clientID := os.Getenv("OAUTH_CLIENT_ID")
+	if clientID == "" && appengine.IsDevAppServer() {
+		return fakeProvider{}
+	}
+	return googleProvider{
+		conf: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
+			Endpoint:     google.Endpoint,
+			Scopes:       []string{"openid", "email", "profile"},
+		},
+	}
+}
+
+// googleProvider signs people in with their Google account.
+type googleProvider struct {
+	conf oauth2.Config
+}
+
+func (googleProvider) Name() string {
+	return "google"
+}
+
+func (p googleProvider) LoginURL(state, redirectURL string) string {
+	conf := p.conf
+	conf.RedirectURL = redirectURL
+	return conf.AuthCodeURL(state)
+}
+
+func (p googleProvider) Exchange(ctx context.Context, code, redirectURL string) (account, error) {
+	var acc account
+	conf := p.conf
+	conf.RedirectURL = redirectURL
+	tok, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return acc, errors.Wrap(err, "exchange")
+	}
+	res, err := conf.Client(ctx, tok).Get("https://openidconnect.googleapis.com/v1/userinfo")
+	if err != nil {
+		return acc, errors.Wrap(err, "userinfo")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return acc, errors.Errorf("userinfo: %s", res.Status)
+	}
+	var info struct {
+		Sub   string `json:"sub"`
+		Email string `json:"email"`
+		Name  string `json:"name"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return acc, errors.Wrap(err, "decode userinfo")
+	}
+	acc = account{
+		Subject: info.Sub,
+		Email:   info.Email,
+		Name:    info.Name,
+	}
+	return acc, nil
+}
+
+// fakeProvider signs everybody in as gopher@example.com without
+// asking. It is for local runs and tests only.
+type fakeProvider struct{}
+
+func (fakeProvider) Name() string {
+	return "fake"
+}
+
+func (fakeProvider) LoginURL(state, redirectURL string) string {
+	return redirectURL + "?" + url.Values{
+		"state": []string{state},
+		"code":  []string{"gopher@example.com"},
+	}.Encode()
+}
+
+func (fakeProvider) Exchange(ctx context.Context, code, redirectURL string) (account, error) {
+	acc := account{
+		Subject: code,
+		Email:   code,
+		Name:    strings.Split(code, "@")[0],
+	}
+	return acc, nil
+}
+
+// handleLogin sends people to the provider to sign in.
+// They come back to the `return` path afterwards.
+func handleLogin(provider authProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		state, err := randomHex(16)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		returnPath := r.URL.Query().Get("return")
+		if !strings.HasPrefix(returnPath, "/") || strings.HasPrefix(returnPath, "//") {
+			returnPath = "/me/gophers"
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookie,
+			Value:    state + "|" + returnPath,
+			Path:     "/auth/",
+			MaxAge:   600,
+			HttpOnly: true,
+			Secure:   !appengine.IsDevAppServer(),
+		})
+		http.Redirect(w, r, provider.LoginURL(state, callbackURL(r)), http.StatusFound)
+	})
+}
+
+// handleAuthCallback completes sign in and starts a session.
+func handleAuthCallback(provider authProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		cookie, err := r.Cookie(stateCookie)
+		if err != nil {
+			http.Error(w, "sign in expired - please try again", http.StatusBadRequest)
+			return
+		}
+		segs := strings.SplitN(cookie.Value, "|", 2)
+		if len(segs) != 2 || !hmac.Equal([]byte(segs[0]), []byte(r.URL.Query().Get("state"))) {
+			http.Error(w, "bad sign in state", http.StatusBadRequest)
+			return
+		}
+		returnPath := segs[1]
+		acc, err := provider.Exchange(ctx, r.URL.Query().Get("code"), callbackURL(r))
+		if err != nil {
+			err = errors.Wrap(err, "sign in")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		userID := provider.Name() + ":" + acc.Subject
+		userKey := datastore.NewKey(ctx, userKind, userID, 0, nil)
+		err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			var user User
+			err := datastore.Get(ctx, userKey, &user)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if err == datastore.ErrNoSuchEntity {
+				user.CTime = time.Now()
+			}
+			user.Email = acc.Email
+			user.Name = acc.Name
+			_, err = datastore.Put(ctx, userKey, &user)
+			return err
+		}, nil)
+		if err != nil {
+			err = errors.Wrap(err, "save User")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := startSession(ctx, w, userID); err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: stateCookie, Path: "/auth/", MaxAge: -1})
+		http.Redirect(w, r, returnPath, http.StatusFound)
+	})
+}
+
+// handleLogout ends the session.
+func handleLogout() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
+
+func callbackURL(r *http.Request) string {
+	scheme := "https"
+	if appengine.IsDevAppServer() {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + "/auth/callback"
+}
+
+// currentUser gets the signed in User, or nil if nobody is signed in.
+func currentUser(ctx context.Context, r *http.Request) (*User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	userID, ok := verifySession(ctx, cookie.Value)
+	if !ok {
+		return nil, nil
+	}
+	var user User
+	err = datastore.Get(ctx, datastore.NewKey(ctx, userKind, userID, 0, nil), &user)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "load User")
+	}
+	user.ID = userID
+	return &user, nil
+}
+
+// startSession sets a signed session cookie for the user.
+func startSession(ctx context.Context, w http.ResponseWriter, userID string) error {
+	secret, err := sessionSecret(ctx)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(sessionTimeout)
+	payload := userID + "|" + strconv.FormatInt(expires.Unix(), 10)
+	value := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + sign(secret, payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   !appengine.IsDevAppServer(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// verifySession checks the session cookie value and gets the user ID
+// from it.
+func verifySession(ctx context.Context, value string) (string, bool) {
+	segs := strings.SplitN(value, ".", 2)
+	if len(segs) != 2 {
+		return "", false
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(segs[0])
+	if err != nil {
+		return "", false
+	}
+	payload := string(payloadBytes)
+	secret, err := sessionSecret(ctx)
+	if err != nil {
+		log.Warningf(ctx, "%s", err)
+		return "", false
+	}
+	if !hmac.Equal([]byte(sign(secret, payload)), []byte(segs[1])) {
+		return "", false
+	}
+	i := strings.LastIndex(payload, "|")
+	if i == -1 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return payload[:i], true
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// secret is a randomly generated key stored in datastore.
+type secret struct {
+	Value []byte `datastore:",noindex"`
+}
+
+var secrets = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: make(map[string][]byte)}
+
+// loadSecret gets the named secret, generating it the first time.
+func loadSecret(ctx context.Context, name string) ([]byte, error) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	if value, ok := secrets.m[name]; ok {
+		return value, nil
+	}
+	key := datastore.NewKey(ctx, secretKind, name, 0, nil)
+	var s secret
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		err := datastore.Get(ctx, key, &s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Value = make([]byte, 32)
+		if _, err := rand.Read(s.Value); err != nil {
+			return err
+		}
+		_, err = datastore.Put(ctx, key, &s)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "load secret")
+	}
+	secrets.m[name] = s.Value
+	return s.Value, nil
+}
+
+func sessionSecret(ctx context.Context) ([]byte, error) {
+	return loadSecret(ctx, "session")
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "random")
+	}
+	return hex.EncodeToString(b), nil
+}
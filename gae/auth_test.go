@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestSignIn(t *testing.T) {
+	inst := newTestInstance(t)
+	defer inst.Close()
+	session := signIn(t, inst)
+
+	r := newTestRequest(t, inst, "GET", "/me/gophers/json", nil, session)
+	ctx := appengine.NewContext(r)
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user == nil {
+		t.Fatal("not signed in")
+	}
+	if user.ID != "fake:gopher@example.com" {
+		t.Errorf("ID: got %q", user.ID)
+	}
+	if user.Email != "gopher@example.com" || user.Name != "gopher" {
+		t.Errorf("got %s <%s>", user.Name, user.Email)
+	}
+	var stored User
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, userKind, user.ID, 0, nil), &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	r = newTestRequest(t, inst, "GET", "/me/gophers/json", nil)
+	w := serve("/me/gophers/json", handleMyGophersAPI(), r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("signed out: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
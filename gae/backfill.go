@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	backfillKind = "Backfill"
+	backfillPath = "/jobs/backfill"
+	// backfillBatch is how many entities a backfill step works on.
+	backfillBatch = 100
+	// backfillBudget is how long a cron run spends on backfills before
+	// leaving the rest for the next run.
+	backfillBudget = 5 * time.Minute
+)
+
+// Backfills.
+const (
+	// backfillGopherImages puts every Gopher again, so ones saved
+	// before Images was indexed can be found by image.
+	backfillGopherImages = "gopher-images"
+	// backfillGopherDaily counts the gophers made each day before the
+	// daily counters were kept.
+	backfillGopherDaily = "gopher-daily"
+	// backfillSavedGophers and backfillRosterGophers put every
+	// SavedGopher and Roster again with their gophers indexed, so a
+	// gopher can be taken out of them all.
+	backfillSavedGophers  = "saved-gophers"
+	backfillRosterGophers = "roster-gophers"
+)
+
+// Backfill is the progress of a backfill. Its key name is the name of
+// the backfill.
+type Backfill struct {
+	Cursor string    `datastore:",noindex"`
+	Done   bool      `datastore:",noindex"`
+	Count  int64     `datastore:",noindex"`
+	MTime  time.Time `datastore:",noindex"`
+}
+
+// backfillStep does a batch of a backfill from cursor, which is empty
+// to start. It gets the cursor to carry on from, how many entities it
+// did, and whether the backfill has finished.
+type backfillStep func(ctx context.Context, cursor string) (next string, n int, done bool, err error)
+
+// backfills are the steps of each backfill, in the order they run.
+var backfills = []struct {
+	name string
+	step backfillStep
+}{
+	{name: backfillGopherImages, step: reindexGophers},
+	{name: backfillGopherDaily, step: countGopherDay},
+	{name: backfillSavedGophers, step: reindexSavedGophers},
+	{name: backfillRosterGophers, step: reindexRosters},
+}
+
+// backfillDone gets whether the named backfill has finished.
+func backfillDone(ctx context.Context, name string) (bool, error) {
+	var b Backfill
+	err := datastore.Get(ctx, datastore.NewKey(ctx, backfillKind, name, 0, nil), &b)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "load Backfill")
+	}
+	return b.Done, nil
+}
+
+// runBackfill runs steps of the named backfill until it finishes or
+// deadline passes, recording its progress after each one.
+func runBackfill(ctx context.Context, name string, step backfillStep, deadline time.Time) error {
+	key := datastore.NewKey(ctx, backfillKind, name, 0, nil)
+	var b Backfill
+	if err := datastore.Get(ctx, key, &b); err != nil && err != datastore.ErrNoSuchEntity {
+		return errors.Wrap(err, "load Backfill")
+	}
+	for !b.Done && time.Now().Before(deadline) {
+		next, n, done, err := step(ctx, b.Cursor)
+		if err != nil {
+			return errors.Wrapf(err, "backfill %s", name)
+		}
+		b.Cursor, b.Done, b.MTime = next, done, time.Now()
+		b.Count += int64(n)
+		if _, err := datastore.Put(ctx, key, &b); err != nil {
+			return errors.Wrap(err, "put Backfill")
+		}
+	}
+	if b.Done {
+		log.Infof(ctx, "backfill %s: done (%d)", name, b.Count)
+	} else {
+		log.Infof(ctx, "backfill %s: %d so far", name, b.Count)
+	}
+	return nil
+}
+
+// handleBackfill carries on with the backfills that haven't finished.
+// It is run by cron until they all have.
+func handleBackfill() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Header.Get("X-Appengine-Cron") != "true" {
+			http.Error(w, "cron only", http.StatusForbidden)
+			return
+		}
+		deadline := time.Now().Add(backfillBudget)
+		for _, b := range backfills {
+			if err := runBackfill(ctx, b.name, b.step, deadline); err != nil {
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	})
+}
+
+// reindexGophers puts a batch of gophers again, so their Images are
+// indexed.
+func reindexGophers(ctx context.Context, cursor string) (string, int, bool, error) {
+	return putEach(ctx, gopherKind, cursor, func(ctx context.Context, key *datastore.Key) error {
+		var gopher Gopher
+		if err := datastore.Get(ctx, key, &gopher); err != nil {
+			return err
+		}
+		_, err := datastore.Put(ctx, key, &gopher)
+		return err
+	})
+}
+
+// reindexSavedGophers puts a batch of SavedGophers again with their
+// Gopher set.
+func reindexSavedGophers(ctx context.Context, cursor string) (string, int, bool, error) {
+	return putEach(ctx, savedGopherKind, cursor, func(ctx context.Context, key *datastore.Key) error {
+		var saved SavedGopher
+		if err := datastore.Get(ctx, key, &saved); err != nil {
+			return err
+		}
+		saved.Gopher = key.StringID()
+		_, err := datastore.Put(ctx, key, &saved)
+		return err
+	})
+}
+
+// reindexRosters puts a batch of Rosters again with their Gophers set.
+func reindexRosters(ctx context.Context, cursor string) (string, int, bool, error) {
+	return putEach(ctx, rosterKind, cursor, func(ctx context.Context, key *datastore.Key) error {
+		var roster Roster
+		if err := datastore.Get(ctx, key, &roster); err != nil {
+			return err
+		}
+		roster.indexGophers()
+		_, err := datastore.Put(ctx, key, &roster)
+		return err
+	})
+}
+
+// putEach calls put in a transaction for each of a batch of entities of
+// kind from cursor, one at a time so changes made meanwhile aren't
+// lost. Entities deleted meanwhile are skipped.
+func putEach(ctx context.Context, kind, cursor string, put func(ctx context.Context, key *datastore.Key) error) (string, int, bool, error) {
+	q := datastore.NewQuery(kind).KeysOnly().Limit(backfillBatch)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", 0, false, errors.Wrap(err, "cursor")
+		}
+		q = q.Start(c)
+	}
+	var keys []*datastore.Key
+	it := q.Run(ctx)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return "", 0, false, errors.Wrap(err, "load "+kind)
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			return put(ctx, key)
+		}, nil)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return "", 0, false, errors.Wrap(err, "put "+kind)
+		}
+	}
+	next, err := it.Cursor()
+	if err != nil {
+		return "", 0, false, errors.Wrap(err, "cursor")
+	}
+	return next.String(), len(keys), len(keys) < backfillBatch, nil
+}
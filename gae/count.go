@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// gophersTotal is the name of the counter holding the total
+	// number of gophers.
+	gophersTotal = "total"
+	dayFormat    = "2006-01-02"
+	// reconcileDays is how many days before today the reconcile cron
+	// recounts, so gophers stored just after midnight are caught.
+	reconcileDays = 2
+)
+
+// countGopher adds delta to the gopher counters for a gopher created
+// at ctime: 1 when it is stored and -1 when it is deleted. The total and
+// the days are kept together, which reconciling relies on. ctx must be a
+// cross-group transaction context.
+func countGopher(ctx context.Context, ctime time.Time, delta int64) error {
+	if err := server.IncrementInTransaction(ctx, server.CounterGophers, gophersTotal, delta); err != nil {
+		return errors.Wrap(err, "count total")
+	}
+	day := ctime.UTC().Format(dayFormat)
+	if err := server.IncrementInTransaction(ctx, server.CounterGophersDaily, day, delta); err != nil {
+		return errors.Wrap(err, "count day")
+	}
+	return nil
+}
+
+// gopherGrowth is the number of gophers created in the period
+// starting at Date.
+type gopherGrowth struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+}
+
+// growth gets the number of gophers created (and not since deleted) per day (or per week,
+// starting on Mondays) over the days up to and including now.
+func growth(ctx context.Context, now time.Time, days int, weekly bool) ([]gopherGrowth, error) {
+	now = now.UTC()
+	from := now.AddDate(0, 0, 1-days)
+	if weekly {
+		// start on a Monday
+		from = from.AddDate(0, 0, -((int(from.Weekday()) + 6) % 7))
+	}
+	totals, err := server.CountRange(ctx, server.CounterGophersDaily, from.Format(dayFormat), now.Format(dayFormat))
+	if err != nil {
+		return nil, err
+	}
+	var series []gopherGrowth
+	for d := from; !d.After(now); d = d.AddDate(0, 0, 1) {
+		n := totals[d.Format(dayFormat)]
+		if weekly && len(series) > 0 && d.Weekday() != time.Monday {
+			series[len(series)-1].Count += n
+			continue
+		}
+		series = append(series, gopherGrowth{Date: d.Format(dayFormat), Count: n})
+	}
+	return series, nil
+}
+
+// countGopherDay is the step of the gopher-daily backfill, which sets
+// the daily counter of each day before today from the CTime of the
+// gophers made on it. cursor is the day to count; empty starts at the
+// day of the first gopher.
+func countGopherDay(ctx context.Context, cursor string) (string, int, bool, error) {
+	var day time.Time
+	if cursor == "" {
+		var first []Gopher
+		if _, err := datastore.NewQuery(gopherKind).Order("CTime").Limit(1).GetAll(ctx, &first); err != nil {
+			return "", 0, false, errors.Wrap(err, "load first gopher")
+		}
+		if len(first) == 0 {
+			return "", 0, true, nil
+		}
+		cursor = first[0].CTime.UTC().Format(dayFormat)
+	}
+	day, err := time.Parse(dayFormat, cursor)
+	if err != nil {
+		return "", 0, false, errors.Wrap(err, "cursor")
+	}
+	// today's gophers are still being made
+	if !day.Before(time.Now().UTC().Truncate(24 * time.Hour)) {
+		return cursor, 0, true, nil
+	}
+	next := day.AddDate(0, 0, 1)
+	n, err := datastore.NewQuery(gopherKind).Filter("CTime >=", day).Filter("CTime <", next).KeysOnly().Count(ctx)
+	if err != nil {
+		return "", 0, false, errors.Wrap(err, "count gophers")
+	}
+	drift, err := server.SetCount(ctx, server.CounterGophersDaily, cursor, int64(n))
+	if err != nil {
+		return "", 0, false, err
+	}
+	if drift != 0 {
+		log.Infof(ctx, "gophers on %s: counted %d, corrected by %d", cursor, n, drift)
+	}
+	return next.Format(dayFormat), n, false, nil
+}
+
+// reconcileGopherDay counts the gophers made on day, which must be
+// over, and corrects its daily counter. Every gopher is counted in both
+// its day and the total, so the total is corrected by as much in the
+// same transaction: adding the drift, rather than setting the total,
+// keeps the gophers made meanwhile.
+func reconcileGopherDay(ctx context.Context, day time.Time) (int, int64, error) {
+	n, err := datastore.NewQuery(gopherKind).Filter("CTime >=", day).Filter("CTime <", day.AddDate(0, 0, 1)).KeysOnly().Count(ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "count gophers")
+	}
+	var drift int64
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		drift, err = server.SetCountInTransaction(ctx, server.CounterGophersDaily, day.Format(dayFormat), int64(n))
+		if err != nil || drift == 0 {
+			return err
+		}
+		return server.IncrementInTransaction(ctx, server.CounterGophers, gophersTotal, drift)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "correct counts")
+	}
+	return n, drift, nil
+}
+
+// handleReconcileGophersCount recounts the gophers made on the last few
+// days, and corrects their daily counters and the total if they have
+// drifted. Only days that are over are counted, so it is a bounded scan
+// that no new gophers can change. It is run by cron.
+func handleReconcileGophersCount() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Header.Get("X-Appengine-Cron") != "true" {
+			http.Error(w, "cron only", http.StatusForbidden)
+			return
+		}
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		for i := reconcileDays; i > 0; i-- {
+			day := today.AddDate(0, 0, -i)
+			n, drift, err := reconcileGopherDay(ctx, day)
+			if err != nil {
+				err = errors.Wrap(err, "counting gophers is hard")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if drift != 0 {
+				log.Infof(ctx, "gophers on %s drifted by %d (actual %d)", day.Format(dayFormat), drift, n)
+			}
+		}
+	})
+}
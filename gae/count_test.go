@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matryer/gopherize.me/server"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestReconcileGopherDay(t *testing.T) {
+	inst := newTestInstance(t)
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	// three gophers yesterday, only one of them counted
+	for i := 0; i < 3; i++ {
+		key := datastore.NewKey(ctx, gopherKind, fmt.Sprint("gopher", i), 0, nil)
+		if _, err := datastore.Put(ctx, key, &Gopher{CTime: day.Add(time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		return countGopher(ctx, day, 1)
+	}, &datastore.TransactionOptions{XG: true}); err != nil {
+		t.Fatal(err)
+	}
+	// a gopher counted today isn't lost by the reconcile
+	if err := server.Increment(ctx, server.CounterGophers, gophersTotal, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	n, drift, err := reconcileGopherDay(ctx, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || drift != 2 {
+		t.Errorf("got %d gophers and drift %d, want 3 and 2", n, drift)
+	}
+	totals, err := server.CountRange(ctx, server.CounterGophersDaily, day.Format(dayFormat), day.Format(dayFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := totals[day.Format(dayFormat)]; got != 3 {
+		t.Errorf("day: got %d, want 3", got)
+	}
+	total, err := server.Count(ctx, server.CounterGophers, gophersTotal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 {
+		t.Errorf("total: got %d, want 4", total)
+	}
+	// it is settled now
+	if _, drift, err := reconcileGopherDay(ctx, day); err != nil || drift != 0 {
+		t.Errorf("again: got drift %d, %v, want 0", drift, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// csrfCookie holds a random value for the browser. Forms prove
+	// they come from our pages by sending the token signed from it,
+	// which other sites can't read.
+	csrfCookie = "csrf"
+	// csrfField is the form field, or csrfHeader the header, with
+	// the token.
+	csrfField  = "csrf_token"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken gets the token for the browser's csrf cookie, setting the
+// cookie first if it doesn't have one.
+func csrfToken(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, error) {
+	secret, err := loadSecret(ctx, "csrf")
+	if err != nil {
+		return "", err
+	}
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 32 {
+		return sign(secret, cookie.Value), nil
+	}
+	value, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   !appengine.IsDevAppServer(),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return sign(secret, value), nil
+}
+
+// checkCSRF checks the request carries the token for its csrf cookie.
+func checkCSRF(ctx context.Context, r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfField)
+	}
+	if token == "" {
+		return false
+	}
+	secret, err := loadSecret(ctx, "csrf")
+	if err != nil {
+		log.Warningf(ctx, "%s", err)
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(sign(secret, cookie.Value)))
+}
+
+// handleCSRFToken gets a token for the page to send with its forms.
+func handleCSRFToken() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		token, err := csrfToken(ctx, w, r)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		respondJSON(ctx, w, http.StatusOK, struct {
+			Token string `json:"token"`
+		}{Token: token})
+	})
+}
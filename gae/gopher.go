@@ -1,27 +1,22 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"encoding/json"
-	"fmt"
 	"html/template"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"cloud.google.com/go/storage"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/gorilla/mux"
 	"github.com/matryer/gopherize.me/server"
 	"github.com/pkg/errors"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/blobstore"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/file"
-	"google.golang.org/appengine/image"
 	"google.golang.org/appengine/log"
 )
 
@@ -31,11 +26,65 @@ const (
 
 type Gopher struct {
 	ID           string    `datastore:"-" json:"id,omitempty"`
-	Images       []string  `datastore:",noindex" json:"images"`
+	Images       []string  `json:"images"`         // indexed for the ?image= gallery filter
+	Pack         string    `json:"pack,omitempty"` // artwork pack, empty for the default
 	OriginalURL  string    `datastore:",noindex" json:"original_url"`
 	URL          string    `datastore:",noindex" json:"url"`
 	ThumbnailURL string    `datastore:",noindex" json:"thumbnail_url"`
+	Owner        string    `json:"-"` // ID of the User who first saved it
+	Name         string    `datastore:",noindex" json:"name,omitempty"`
+	Caption      string    `datastore:",noindex" json:"caption,omitempty"`
+	AltText      string    `datastore:",noindex" json:"alt_text,omitempty"`
 	CTime        time.Time `json:"ctime"`
+	Hidden       bool      `json:"hidden,omitempty"` // kept out of the public feeds by an admin
+}
+
+// Limits on the text people can attach to a gopher, in characters.
+const (
+	maxNameLen    = 60
+	maxCaptionLen = 140
+	maxAltTextLen = 250
+)
+
+// cleanText trims s and checks it is valid UTF-8 of at most max
+// characters without control characters. Text is stored as given and
+// escaped when it is rendered.
+func cleanText(field, s string, max int) (string, error) {
+	s = strings.TrimSpace(s)
+	if !utf8.ValidString(s) {
+		return "", errors.Errorf("%s must be valid UTF-8", field)
+	}
+	if utf8.RuneCountInString(s) > max {
+		return "", errors.Errorf("%s must be %d characters or fewer", field, max)
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return "", errors.Errorf("%s must not contain control characters", field)
+		}
+	}
+	return s, nil
+}
+
+// hasDetails gets whether any text was given with the gopher.
+func hasDetails(details Gopher) bool {
+	return details.Name != "" || details.Caption != "" || details.AltText != ""
+}
+
+// readDetails gets the name, caption and alt text for a gopher from
+// the request.
+func readDetails(r *http.Request) (Gopher, error) {
+	var details Gopher
+	var err error
+	if details.Name, err = cleanText("name", r.FormValue("name"), maxNameLen); err != nil {
+		return details, err
+	}
+	if details.Caption, err = cleanText("caption", r.FormValue("caption"), maxCaptionLen); err != nil {
+		return details, err
+	}
+	if details.AltText, err = cleanText("alt", r.FormValue("alt"), maxAltTextLen); err != nil {
+		return details, err
+	}
+	return details, nil
 }
 
 var ageMagnitudes = []humanize.RelTimeMagnitude{
@@ -62,106 +111,229 @@ func (g Gopher) Age() string {
 	return humanize.CustomRelTime(g.CTime, time.Now(), "old", "", ageMagnitudes)
 }
 
-func handleSave() http.Handler {
+// Limits on saves from each IP address: saveRate a minute, up to
+// saveBurst at once.
+const (
+	saveRate  = 0.5
+	saveBurst = 10
+)
+
+// handleSave queues the creation of the selected gopher and sends
+// the user to its page, which shows a pending state until it is ready.
+// Clients that accept JSON get the gopher ID and status URL instead.
+// Saves must be POSTed with a CSRF token, pick only artwork that is in
+// the picker and are limited for each IP address by rates.
+func handleSave(queue jobQueue, rates server.RateStore) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := appengine.NewContext(r)
-		imageList := r.URL.Query().Get("images")
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkCSRF(ctx, r) {
+			http.Error(w, "this page has expired - please reload it and try again", http.StatusForbidden)
+			return
+		}
+		imageList := r.FormValue("images")
 		images := strings.Split(imageList, "|")
-		if len(images) == 0 {
-			http.Error(w, "missing images", http.StatusBadRequest)
+		pack, err := server.ImagesPack(images, r.FormValue("pack"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if private, err := server.PackPrivate(ctx, pack); err != nil {
+			err = errors.Wrap(err, "check pack")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if private {
+			http.Error(w, errPrivateSave.Error(), http.StatusForbidden)
+			return
+		}
+		if err := server.CheckSelection(ctx, images, pack); err != nil {
+			switch err {
+			case server.ErrEmptySelection, server.ErrArtworkUnavailable, server.ErrSameCategory:
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				err = errors.Wrap(err, "check selection")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if wait, err := rates.Take(ctx, "save:"+server.ClientIP(r), saveRate/60, saveBurst, 1); err != nil {
+			// let the save through rather than lose it
+			log.Warningf(ctx, "save limit: %s", err)
+		} else if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many saves - please wait a little and try again", http.StatusTooManyRequests)
 			return
 		}
 		imageList = strings.Join(images, "|")
-		imagesHash := hash(imageList)
+		imagesHash := server.Hash(imageList)
+		details, err := readDetails(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		details.Images = images
+		user, err := currentUser(ctx, r)
+		if err != nil {
+			// saving works without an account
+			log.Warningf(ctx, "%s", err)
+		}
+		if user != nil {
+			details.Owner = user.ID
+			if err := collectGopher(ctx, user.ID, imagesHash, details); err != nil {
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		gopherKey := datastore.NewKey(ctx, gopherKind, imagesHash, 0, nil)
 		var gopher Gopher
-		err := datastore.Get(ctx, gopherKey, &gopher)
+		err = datastore.Get(ctx, gopherKey, &gopher)
 		if err != datastore.ErrNoSuchEntity && err != nil {
 			err = errors.Wrap(err, "read Gopher")
 			log.Errorf(ctx, "%s", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		status := jobDone
+		// only the first save of a gopher gives it its text
+		applied := false
 		if err == nil {
 			log.Debugf(ctx, "already rendered - skipping: %s", images)
+			if err := server.Increment(ctx, server.CounterGopherSaves, imagesHash, 1); err != nil {
+				log.Warningf(ctx, "%s", err)
+			}
 		}
 		if err == datastore.ErrNoSuchEntity {
-			// gopher doesn't exist - create it
-			log.Debugf(ctx, "rendering: %s", images)
-			var buf bytes.Buffer
-			if err := server.Render(ctx, &buf, images); err != nil {
-				err = errors.Wrap(err, "rendering")
+			status = jobPending
+			if applied, err = enqueueSave(ctx, queue, imagesHash, details); err != nil {
+				err = errors.Wrap(err, "queue save")
 				log.Errorf(ctx, "%s", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			bucket, err := file.DefaultBucketName(ctx)
-			if err != nil {
-				err = errors.Wrap(err, "DefaultBucketName")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			client, err := storage.NewClient(ctx)
-			if err != nil {
-				err = errors.Wrap(err, "storage.NewClient")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+		}
+		var notice string
+		if !applied && hasDetails(details) {
+			notice = detailsKeptNotice
+			if user != nil {
+				notice += " Yours are kept in your collection."
 			}
-			objpath := "gophers/" + imagesHash + ".png"
-			object := client.Bucket(bucket).Object(objpath)
-			objW := object.NewWriter(ctx)
-			objW.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-			objW.CacheControl = "public, max-age=31536000"
-			if err := server.Render(ctx, objW, images); err != nil {
-				objW.Close()
-				err = errors.Wrap(err, "Render")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+		}
+		gopherURL := "/gopher/" + imagesHash
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			response := saveStatus{
+				ID:        imagesHash,
+				Status:    status,
+				URL:       gopherURL,
+				StatusURL: gopherURL + "/status",
+				Notice:    notice,
 			}
-			if err := objW.Close(); err != nil {
-				err = errors.Wrap(err, "Close writer")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				log.Errorf(ctx, "encode save status: %s", err)
 			}
+			return
+		}
+		if notice != "" {
+			gopherURL += "?details=kept"
+		}
+		http.Redirect(w, r, gopherURL, http.StatusSeeOther)
+	})
+}
 
-			blobkey, err := blobstore.BlobKeyForFile(ctx, fmt.Sprintf("/gs/%s/%s", bucket, objpath))
-			if err != nil {
-				err = errors.Wrap(err, "BlobKeyForFile")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// detailsKeptNotice tells people their text wasn't put on a gopher
+// that somebody else saved first.
+const detailsKeptNotice = "This Gopher was already saved, so it keeps the name, caption and alt text it was given then."
 
-			absURL, err := image.ServingURL(ctx, blobkey, &image.ServingURLOptions{Secure: true})
-			if err != nil {
-				err = errors.Wrap(err, "ServingURL (abs)")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			absURLStr := absURL.String()
-			thumbURL, err := image.ServingURL(ctx, blobkey, &image.ServingURLOptions{Secure: true, Size: 70})
-			if err != nil {
-				err = errors.Wrap(err, "ServingURL (thumb)")
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			thumbURLStr := thumbURL.String()
+// saveStatus describes the progress of a save.
+type saveStatus struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	URL       string `json:"url"`
+	StatusURL string `json:"status_url"`
+	// Notice tells the saver about anything that didn't go as asked.
+	Notice string `json:"notice,omitempty"`
+}
 
-			gopher = Gopher{
-				Images:       images,
-				CTime:        time.Now(),
-				URL:          absURLStr,
-				ThumbnailURL: thumbURLStr,
-				OriginalURL:  fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, objpath),
-			}
-			gopherKey, err = datastore.Put(ctx, gopherKey, &gopher)
-			if err != nil {
-				err = errors.Wrap(err, "save Gopher")
-				log.Errorf(ctx, "%s", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+// handleModerateGopher hides a gopher from the recent feed, /grid and
+// the popular lists with the form value hidden=true, or shows it again
+// with hidden=false. Its own page still works.
+func handleModerateGopher() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		hidden := r.FormValue("hidden")
+		if hidden != "true" && hidden != "false" {
+			http.Error(w, "hidden must be true or false", http.StatusBadRequest)
+			return
+		}
+		gopherHash := mux.Vars(r)["gopherhash"]
+		err := setGopherHidden(ctx, gopherHash, hidden == "true")
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s set hidden=%s on gopher %s", user.Email, hidden, gopherHash)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// handleGopherStatus gets the saveStatus of a gopher.
+func handleGopherStatus() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		gopherHash := mux.Vars(r)["gopherhash"]
+		gopherURL := "/gopher/" + gopherHash
+		response := saveStatus{
+			ID:        gopherHash,
+			Status:    jobDone,
+			URL:       gopherURL,
+			StatusURL: gopherURL + "/status",
+		}
+		var gopher Gopher
+		err := datastore.Get(ctx, datastore.NewKey(ctx, gopherKind, gopherHash, 0, nil), &gopher)
+		if err == datastore.ErrNoSuchEntity {
+			var job SaveJob
+			err = datastore.Get(ctx, datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil), &job)
+			response.Status = job.Status
+			response.Error = job.Error
+		}
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			err = errors.Wrap(err, "load gopher")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			err = errors.Wrap(err, "encode status")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		http.Redirect(w, r, "/gopher/"+gopherKey.StringID(), 308) // StatusPermanentRedirect
 	})
 }
 
@@ -181,10 +353,12 @@ func handleGopher() http.Handler {
 				Gopher      Gopher
 				GopherHash  string
 				CacheBuster string
+				Status      string
 			}{
 				PageURL:     "https://gopherize.me/gopher/" + gopherHash,
 				GopherHash:  gopherHash,
 				CacheBuster: time.Now().String(),
+				Status:      jobDone,
 				Gopher: Gopher{
 					CTime:        time.Now(),
 					URL:          "https://lh3.googleusercontent.com/6VExrE4MS9Z7FbK-Os9pYdnoXl0etzyCganMXyHv3Rd8eqdiDwmLxP8FdaRD07zUweE7yFq1jaWl9Em1Jssrxbs",
@@ -201,8 +375,14 @@ func handleGopher() http.Handler {
 		}
 
 		var gopher Gopher
+		var job SaveJob
 		gopherKey := datastore.NewKey(ctx, gopherKind, gopherHash, 0, nil)
 		err := datastore.Get(ctx, gopherKey, &gopher)
+		if err == datastore.ErrNoSuchEntity {
+			// it may still be being made
+			jobKey := datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil)
+			err = datastore.Get(ctx, jobKey, &job)
+		}
 		if err == datastore.ErrNoSuchEntity {
 			http.NotFound(w, r)
 			return
@@ -213,17 +393,29 @@ func handleGopher() http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if job.Status == "" {
+			job.Status = jobDone
+		}
+		if err := server.Increment(ctx, server.CounterGopherViews, gopherHash, 1); err != nil {
+			log.Warningf(ctx, "%s", err)
+		}
 
 		pageInfo := struct {
 			PageURL     string
 			Gopher      Gopher
 			GopherHash  string
 			CacheBuster string
+			Status      string
+			Notice      string
 		}{
 			PageURL:     "https://gopherize.me/gopher/" + gopherHash,
 			Gopher:      gopher,
 			GopherHash:  gopherHash,
 			CacheBuster: appengine.VersionID(ctx),
+			Status:      job.Status,
+		}
+		if r.URL.Query().Get("details") == "kept" {
+			pageInfo.Notice = detailsKeptNotice
 		}
 		w.Header().Set("Content-Type", "text/html")
 		if err := tpl.ExecuteTemplate(w, "layout", pageInfo); err != nil {
@@ -233,6 +425,45 @@ func handleGopher() http.Handler {
 	})
 }
 
+// handleGopherDownload counts the download and redirects to the
+// original image. Gophers still being made, or that failed, get a 409
+// pointing at their status.
+func handleGopherDownload() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		gopherHash := mux.Vars(r)["gopherhash"]
+		var gopher Gopher
+		var job SaveJob
+		gopherKey := datastore.NewKey(ctx, gopherKind, gopherHash, 0, nil)
+		err := datastore.Get(ctx, gopherKey, &gopher)
+		if err == datastore.ErrNoSuchEntity {
+			// it may still be being made
+			jobKey := datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil)
+			err = datastore.Get(ctx, jobKey, &job)
+		}
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			err = errors.Wrap(err, "load gopher")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if gopher.OriginalURL == "" {
+			// still being made, or failed
+			w.Header().Set("Location", "/gopher/"+gopherHash+"/status")
+			http.Error(w, "gopher is "+job.Status, http.StatusConflict)
+			return
+		}
+		if err := server.Increment(ctx, server.CounterGopherDownloads, gopherHash, 1); err != nil {
+			log.Warningf(ctx, "%s", err)
+		}
+		http.Redirect(w, r, gopher.OriginalURL, http.StatusFound)
+	})
+}
+
 func handleGopherAPI() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := appengine.NewContext(r)
@@ -251,7 +482,7 @@ func handleGopherAPI() http.Handler {
 			return
 		}
 		imageList := strings.Join(gopher.Images, "|")
-		gopher.ID = hash(imageList)
+		gopher.ID = server.Hash(imageList)
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(gopher); err != nil {
 			err = errors.Wrap(err, "encode gopher")
@@ -262,30 +493,177 @@ func handleGopherAPI() http.Handler {
 	})
 }
 
+// maxRecentGophers is the largest page size handleRecentGophers
+// will return.
+const maxRecentGophers = 1000
+
+// gopherQuery builds a query for Gopher entities from the
+// request parameters:
+//
+//	limit  - maximum number of gophers to return (default 100)
+//	cursor - the `next` value from a previous page
+//	since  - only gophers created at or after this RFC3339 time
+//	until  - only gophers created before this RFC3339 time
+//	image  - only gophers that use this artwork item ID (older gophers
+//	         are found once the gopher-images backfill has run)
+func gopherQuery(r *http.Request) (*datastore.Query, int, error) {
+	q := r.URL.Query()
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 100
+	}
+	if limit > maxRecentGophers {
+		limit = maxRecentGophers
+	}
+	query := datastore.NewQuery(gopherKind).Order("-CTime").Limit(limit)
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "since")
+		}
+		query = query.Filter("CTime >=", t)
+	}
+	if until := q.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "until")
+		}
+		query = query.Filter("CTime <", t)
+	}
+	if img := q.Get("image"); img != "" {
+		query = query.Filter("Images =", img)
+	}
+	if cursorStr := q.Get("cursor"); cursorStr != "" {
+		cursor, err := datastore.DecodeCursor(cursorStr)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "cursor")
+		}
+		query = query.Start(cursor)
+	}
+	return query, limit, nil
+}
+
 func handleRecentGophers() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var response struct {
 			Gophers []Gopher `json:"gophers"`
+			Next    string   `json:"next,omitempty"`
 		}
-		limitStr := r.URL.Query().Get("limit")
-		limit, err := strconv.Atoi(limitStr)
+		ctx := appengine.NewContext(r)
+		query, limit, err := gopherQuery(r)
 		if err != nil {
-			limit = 100
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		it := query.Run(ctx)
+		n := 0
+		for {
+			var gopher Gopher
+			_, err := it.Next(&gopher)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				err = errors.Wrap(err, "load gophers")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			n++
+			if gopher.Hidden {
+				continue
+			}
+			imageList := strings.Join(gopher.Images, "|")
+			gopher.ID = server.Hash(imageList)
+			response.Gophers = append(response.Gophers, gopher)
+		}
+		if n == limit {
+			// a full page means there may be more
+			cursor, err := it.Cursor()
+			if err != nil {
+				err = errors.Wrap(err, "cursor")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.Next = cursor.String()
 		}
-		if limit > 1000 {
-			limit = 1000
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			err = errors.Wrap(err, "encode gopher")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+	})
+}
+
+// popularGopher is a Gopher with its count for the requested
+// metric.
+type popularGopher struct {
+	Gopher
+	Count int64 `json:"count"`
+}
+
+// handlePopularGophers gets the most viewed, downloaded or saved
+// gophers, chosen with the `by` parameter (views, downloads or saves).
+func handlePopularGophers() http.Handler {
+	groups := map[string]string{
+		"views":     server.CounterGopherViews,
+		"downloads": server.CounterGopherDownloads,
+		"saves":     server.CounterGopherSaves,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := appengine.NewContext(r)
-		keys, err := datastore.NewQuery(gopherKind).Limit(limit).Order("-CTime").GetAll(ctx, &response.Gophers)
+		by := r.URL.Query().Get("by")
+		if by == "" {
+			by = "views"
+		}
+		group, ok := groups[by]
+		if !ok {
+			http.Error(w, "by must be views, downloads or saves", http.StatusBadRequest)
+			return
+		}
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			limit = 20
+		}
+		top, err := server.Top(ctx, group, limit)
 		if err != nil {
+			err = errors.Wrap(err, "load popular gophers")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		keys := make([]*datastore.Key, len(top))
+		for i, t := range top {
+			keys[i] = datastore.NewKey(ctx, gopherKind, t.Name, 0, nil)
+		}
+		gophers := make([]Gopher, len(keys))
+		err = datastore.GetMulti(ctx, keys, gophers)
+		merr, _ := err.(appengine.MultiError)
+		if err != nil && merr == nil {
 			err = errors.Wrap(err, "load gophers")
 			log.Errorf(ctx, "%s", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		for i := range keys {
-			imageList := strings.Join(response.Gophers[i].Images, "|")
-			response.Gophers[i].ID = hash(imageList)
+		var response struct {
+			Gophers []popularGopher `json:"gophers"`
+		}
+		for i := range gophers {
+			if merr != nil && merr[i] != nil {
+				// skip gophers that no longer exist
+				continue
+			}
+			if gophers[i].Hidden {
+				continue
+			}
+			gophers[i].ID = top[i].Name
+			response.Gophers = append(response.Gophers, popularGopher{
+				Gopher: gophers[i],
+				Count:  top[i].Count,
+			})
 		}
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -297,10 +675,13 @@ func handleRecentGophers() http.Handler {
 	})
 }
 
+// handleGophersCount gets the total number of gophers.
+// With `by=day` or `by=week` it also includes the number created in
+// each period over the last `days` days (default 30).
 func handleGophersCount() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := appengine.NewContext(r)
-		n, err := datastore.NewQuery(gopherKind).Count(ctx)
+		n, err := server.Count(ctx, server.CounterGophers, gophersTotal)
 		if err != nil {
 			err = errors.Wrap(err, "counting gophers is hard")
 			log.Errorf(ctx, "%s", err)
@@ -308,9 +689,27 @@ func handleGophersCount() http.Handler {
 			return
 		}
 		var response struct {
-			N int `json:"gophers_count"`
+			N      int64          `json:"gophers_count"`
+			Growth []gopherGrowth `json:"growth,omitempty"`
 		}
 		response.N = n
+		if by := r.URL.Query().Get("by"); by != "" {
+			if by != "day" && by != "week" {
+				http.Error(w, "by must be day or week", http.StatusBadRequest)
+				return
+			}
+			days, err := strconv.Atoi(r.URL.Query().Get("days"))
+			if err != nil || days < 1 || days > 366 {
+				days = 30
+			}
+			response.Growth, err = growth(ctx, time.Now(), days, by == "week")
+			if err != nil {
+				err = errors.Wrap(err, "growth")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			err = errors.Wrap(err, "encode gopher")
@@ -320,9 +719,3 @@ func handleGophersCount() http.Handler {
 		}
 	})
 }
-
-func hash(s string) string {
-	hash := sha1.New()
-	hash.Write([]byte(s))
-	return fmt.Sprintf("%x", hash.Sum(nil))
-}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matryer/gopherize.me/server"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// recordQueue is a jobQueue that remembers what was queued.
+type recordQueue struct {
+	hashes *[]string
+}
+
+func (q recordQueue) Enqueue(ctx context.Context, gopherHash string, images []string) error {
+	*q.hashes = append(*q.hashes, gopherHash)
+	return nil
+}
+
+func TestSaveAnonymous(t *testing.T) {
+	inst := newTestInstance(t)
+	defer inst.Close()
+	r := newTestRequest(t, inst, "GET", "/save/token", nil)
+	ctx := appengine.NewContext(r)
+
+	// the cached catalog, so the selection is checked without the bucket
+	images := []string{"artwork/010-Body/blue_gopher.png", "artwork/020-Eyes/crazy_eyes.png"}
+	catalog := struct {
+		Categories []server.Category
+	}{
+		Categories: []server.Category{
+			{ID: "artwork/010-Body/", Name: "Body", Images: []server.Image{{ID: images[0]}}},
+			{ID: "artwork/020-Eyes/", Name: "Eyes", Images: []server.Image{{ID: images[1]}}},
+		},
+	}
+	if err := memcache.Gob.Set(ctx, &memcache.Item{Key: "artwork", Object: catalog}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve("/save/token", handleCSRFToken(), r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token: got %d: %s", w.Code, w.Body)
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	csrf := cookie(t, w, csrfCookie)
+
+	var queued []string
+	save := handleSave(recordQueue{hashes: &queued}, server.MemcacheRateStore{})
+	form := url.Values{
+		"images": {strings.Join(images, "|")},
+		"name":   {"Gordon"},
+	}
+	r = newTestRequest(t, inst, "POST", "/save", form, csrf)
+	if w := serve("/save", save, r); w.Code != http.StatusForbidden {
+		t.Errorf("without token: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	form.Set(csrfField, token.Token)
+	r = newTestRequest(t, inst, "POST", "/save", form, csrf)
+	w = serve("/save", save, r)
+	gopherHash := server.Hash(strings.Join(images, "|"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("save: got %d, want %d: %s", w.Code, http.StatusSeeOther, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != "/gopher/"+gopherHash {
+		t.Errorf("redirect: got %q", got)
+	}
+	if len(queued) != 1 || queued[0] != gopherHash {
+		t.Errorf("queued: got %v, want [%s]", queued, gopherHash)
+	}
+	var job SaveJob
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != jobPending || job.Owner != "" || job.Name != "Gordon" {
+		t.Errorf("got %+v", job)
+	}
+	n, err := datastore.NewQuery(savedGopherKind).KeysOnly().Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("SavedGophers: got %d, want 0", n)
+	}
+
+	// saving again while it is pending doesn't queue it again, and
+	// says the new name wasn't used
+	form.Set("name", "Gracie")
+	r = newTestRequest(t, inst, "POST", "/save", form, csrf)
+	w = serve("/save", save, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("save again: got %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != "/gopher/"+gopherHash+"?details=kept" {
+		t.Errorf("redirect: got %q", got)
+	}
+	if len(queued) != 1 {
+		t.Errorf("queued: got %v", queued)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	saveJobKind = "SaveJob"
+	saveJobPath = "/jobs/save"
+)
+
+// Save job statuses.
+const (
+	jobPending = "pending"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// SaveJob tracks the rendering and uploading of a new gopher.
+// It shares its key name with the Gopher it creates.
+type SaveJob struct {
+	Images  []string  `datastore:",noindex" json:"images"`
+	Owner   string    `datastore:",noindex" json:"-"`
+	Name    string    `datastore:",noindex" json:"name,omitempty"`
+	Caption string    `datastore:",noindex" json:"caption,omitempty"`
+	AltText string    `datastore:",noindex" json:"alt_text,omitempty"`
+	Status  string    `json:"status"`
+	Error   string    `datastore:",noindex" json:"error,omitempty"`
+	CTime   time.Time `json:"ctime"`
+	MTime   time.Time `json:"mtime"`
+}
+
+// details gets the Gopher the job will create, as given by the person
+// saving it.
+func (j SaveJob) details() Gopher {
+	return Gopher{
+		Images:  j.Images,
+		Owner:   j.Owner,
+		Name:    j.Name,
+		Caption: j.Caption,
+		AltText: j.AltText,
+	}
+}
+
+// jobQueue runs save jobs in the background.
+type jobQueue interface {
+	// Enqueue schedules the gopher with the given hash and images to
+	// be created. It is called once the pending SaveJob has been
+	// committed.
+	Enqueue(ctx context.Context, gopherHash string, images []string) error
+}
+
+// newJobQueue gets the task queue backed jobQueue, or a local
+// in-process one when running on the dev server.
+func newJobQueue() jobQueue {
+	if appengine.IsDevAppServer() {
+		return localQueue{}
+	}
+	return taskQueue{}
+}
+
+// taskQueue is a jobQueue that adds App Engine push tasks which are
+// handled by handleSaveJob.
+type taskQueue struct{}
+
+func (taskQueue) Enqueue(ctx context.Context, gopherHash string, images []string) error {
+	task := taskqueue.NewPOSTTask(saveJobPath, url.Values{
+		"gopher": []string{gopherHash},
+		"images": []string{strings.Join(images, "|")},
+	})
+	if _, err := taskqueue.Add(ctx, task, ""); err != nil {
+		return errors.Wrap(err, "add task")
+	}
+	return nil
+}
+
+// localQueue is a jobQueue that runs each job in its own goroutine.
+// Jobs are lost if the process exits, so it is only for local runs.
+type localQueue struct{}
+
+func (localQueue) Enqueue(ctx context.Context, gopherHash string, images []string) error {
+	go func() {
+		ctx := appengine.BackgroundContext()
+		if err := runSaveJob(ctx, gopherHash, images); err != nil {
+			log.Errorf(ctx, "save job %s: %s", gopherHash, err)
+		}
+	}()
+	return nil
+}
+
+// enqueueSave records a pending SaveJob for the gopher and queues it,
+// unless a job for it is already pending or done. queued is false if
+// it wasn't, in which case details aren't used.
+// details are passed to createGopher.
+func enqueueSave(ctx context.Context, queue jobQueue, gopherHash string, details Gopher) (queued bool, err error) {
+	key := datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil)
+	var pending bool
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		pending = false
+		var job SaveJob
+		err := datastore.Get(ctx, key, &job)
+		if err == nil && job.Status != jobFailed {
+			return nil
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		job = SaveJob{
+			Images:  details.Images,
+			Owner:   details.Owner,
+			Name:    details.Name,
+			Caption: details.Caption,
+			AltText: details.AltText,
+			Status:  jobPending,
+			CTime:   now,
+			MTime:   now,
+		}
+		if _, err := datastore.Put(ctx, key, &job); err != nil {
+			return err
+		}
+		pending = true
+		return nil
+	}, nil)
+	if err != nil || !pending {
+		return false, err
+	}
+	if err := queue.Enqueue(ctx, gopherHash, details.Images); err != nil {
+		// fail the job, so saving again queues it again
+		if err := updateSaveJob(ctx, key, jobFailed, err.Error()); err != nil {
+			log.Warningf(ctx, "%s", err)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// runSaveJob creates the gopher and records the outcome on its
+// SaveJob.
+func runSaveJob(ctx context.Context, gopherHash string, images []string) error {
+	key := datastore.NewKey(ctx, saveJobKind, gopherHash, 0, nil)
+	var job SaveJob
+	if err := datastore.Get(ctx, key, &job); err != nil && err != datastore.ErrNoSuchEntity {
+		return errors.Wrap(err, "read SaveJob")
+	}
+	job.Images = images
+	gopherKey := datastore.NewKey(ctx, gopherKind, gopherHash, 0, nil)
+	_, created, err := createGopher(ctx, gopherKey, job.details())
+	status, errStr := jobDone, ""
+	if err != nil {
+		status, errStr = jobFailed, err.Error()
+	}
+	if err := updateSaveJob(ctx, key, status, errStr); err != nil {
+		log.Warningf(ctx, "%s", err)
+	}
+	if err != nil {
+		return err
+	}
+	if created {
+		for _, img := range images {
+			if len(img) == 0 {
+				continue
+			}
+			if err := server.Increment(ctx, server.CounterArtwork, img, 1); err != nil {
+				log.Warningf(ctx, "%s", err)
+			}
+		}
+	}
+	return nil
+}
+
+func updateSaveJob(ctx context.Context, key *datastore.Key, status, errStr string) error {
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var job SaveJob
+		if err := datastore.Get(ctx, key, &job); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		job.Status = status
+		job.Error = errStr
+		job.MTime = time.Now()
+		_, err := datastore.Put(ctx, key, &job)
+		return err
+	}, nil)
+	return errors.Wrap(err, "update SaveJob")
+}
+
+// handleSaveJob is the task queue worker for save jobs. Failures
+// respond with an error so the task is retried.
+func handleSaveJob() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Header.Get("X-AppEngine-QueueName") == "" {
+			http.Error(w, "task queue only", http.StatusForbidden)
+			return
+		}
+		gopherHash := r.FormValue("gopher")
+		images := strings.Split(r.FormValue("images"), "|")
+		if gopherHash != server.Hash(strings.Join(images, "|")) {
+			// bad task - don't retry
+			log.Errorf(ctx, "save job: gopher hash mismatch: %s", gopherHash)
+			return
+		}
+		if err := runSaveJob(ctx, gopherHash, images); err != nil {
+			log.Errorf(ctx, "save job %s: %s", gopherHash, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
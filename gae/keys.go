@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// maxKeyNameLen is the longest name an API key may have.
+	maxKeyNameLen = 60
+	// defaultSignedTTL and maxSignedTTL are how long signed render URLs
+	// last.
+	defaultSignedTTL = 7 * 24 * time.Hour
+	maxSignedTTL     = 5 * 365 * 24 * time.Hour
+)
+
+// handleIssueAPIKey issues an API key from the form values name and
+// rate (requests a minute, optional). The key is only ever shown in
+// this response.
+func handleIssueAPIKey() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		name, err := cleanText("name", r.FormValue("name"), maxKeyNameLen)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		rate, err := intFormValue(r, "rate", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rate != 0 {
+			if err := server.CheckKeyRate(rate); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		k, secret, err := server.IssueAPIKey(ctx, name, user.ID, rate)
+		if err != nil {
+			err = errors.Wrap(err, "issue API key")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s issued API key %s", user.Email, k.ID)
+		respondJSON(ctx, w, http.StatusCreated, struct {
+			server.APIKey
+			Key string `json:"key"`
+		}{APIKey: k, Key: secret})
+	})
+}
+
+// handleAPIKeys lists the issued API keys and their usage.
+func handleAPIKeys() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if _, ok := requireAdmin(w, r); !ok {
+			return
+		}
+		keys, err := server.APIKeys(ctx)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []server.APIKey{}
+		}
+		respondJSON(ctx, w, http.StatusOK, struct {
+			Keys []server.APIKey `json:"keys"`
+		}{Keys: keys})
+	})
+}
+
+// handleRevokeAPIKey revokes an API key with delete or the DELETE
+// method.
+func handleRevokeAPIKey() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodDelete && (r.Method != http.MethodPost || r.FormValue("delete") == "") {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		err := server.RevokeAPIKey(ctx, id)
+		if err == server.ErrAPIKeyNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s revoked API key %s", user.Email, id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// handleFlushAPIKeyUsage adds the API key usage counted in memcache to
+// the keys' counters. It is run by cron.
+func handleFlushAPIKeyUsage() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Header.Get("X-Appengine-Cron") != "true" {
+			http.Error(w, "cron only", http.StatusForbidden)
+			return
+		}
+		if err := server.FlushAPIKeyUsage(ctx); err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+// handleSigningKeys lists the keys that sign render URLs with GET, or
+// rotates to a new one with POST.
+func handleSigningKeys() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		if r.Method == http.MethodPost {
+			k, err := server.RotateSigningKey(ctx)
+			if err != nil {
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof(ctx, "%s rotated signing key to %s", user.Email, k.ID)
+			respondJSON(ctx, w, http.StatusCreated, k)
+			return
+		}
+		keys, err := server.SigningKeys(ctx)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []server.SigningKey{}
+		}
+		respondJSON(ctx, w, http.StatusOK, struct {
+			Keys []server.SigningKey `json:"keys"`
+		}{Keys: keys})
+	})
+}
+
+// handleRetireSigningKey retires a signing key with delete or the
+// DELETE method, so the URLs it signed stop working.
+func handleRetireSigningKey() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodDelete && (r.Method != http.MethodPost || r.FormValue("delete") == "") {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		id := mux.Vars(r)["id"]
+		err := server.RetireSigningKey(ctx, id)
+		if err == server.ErrSigningKeyNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s retired signing key %s", user.Email, id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// handleSignRenderURL signs a render URL from the form values images,
+// the render options, format (png, gif, apng or svg) and ttl (such as
+// 720h, default a week).
+func handleSignRenderURL() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		images := strings.Split(r.Form.Get("images"), "|")
+		if _, err := server.ImagesPack(images, r.Form.Get("pack")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts, err := server.ParseRenderOptions(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := r.Form.Get("format")
+		switch format {
+		case "":
+			format = server.FormatPNG
+		case server.FormatPNG, server.FormatGIF, server.FormatAPNG, server.FormatSVG:
+		default:
+			http.Error(w, "format must be png, gif, apng or svg", http.StatusBadRequest)
+			return
+		}
+		ttl := defaultSignedTTL
+		if s := r.Form.Get("ttl"); s != "" {
+			if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 || ttl > maxSignedTTL {
+				http.Error(w, "ttl must be a duration like 720h, up to five years", http.StatusBadRequest)
+				return
+			}
+		}
+		expires := time.Now().Add(ttl)
+		signed, err := server.SignRenderURL(ctx, format, images, opts, expires)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%s signed %s", user.Email, signed)
+		respondJSON(ctx, w, http.StatusOK, struct {
+			URL     string    `json:"url"`
+			Expires time.Time `json:"expires"`
+		}{URL: signed, Expires: expires})
+	})
+}
+
+func respondJSON(ctx context.Context, w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Errorf(ctx, "encode response: %s", err)
+	}
+}
@@ -10,15 +10,55 @@ import (
 )
 
 func init() {
+	queue := newJobQueue()
+	provider := newAuthProvider()
+	rates := server.MemcacheRateStore{}
 	mux := mux.NewRouter()
 	mux.Handle("/gopher/{gopherhash}/json", handleGopherAPI())
+	mux.Handle("/gopher/{gopherhash}/download", handleGopherDownload())
+	mux.Handle("/gopher/{gopherhash}/status", handleGopherStatus())
+	mux.Handle("/gopher/{gopherhash}/moderate", handleModerateGopher())
 	mux.Handle("/gophers/recent/json", handleRecentGophers())
-	mux.PathPrefix("/api/").Handler(server.New())
+	mux.Handle("/gophers/popular/json", handlePopularGophers())
+	mux.PathPrefix("/api/").Handler(server.New(userInGroups, rates))
 	mux.Handle("/branding", brandingHandler())
-	mux.Handle("/save", handleSave())
+	mux.Handle("/save", handleSave(queue, rates))
+	mux.Handle("/save/token", handleCSRFToken())
+	mux.Handle(saveJobPath, handleSaveJob())
+	mux.Handle(backfillPath, handleBackfill())
+	mux.Handle("/jobs/apikey-usage", handleFlushAPIKeyUsage())
 	mux.Handle("/gopher/{gopherhash}", handleGopher())
 	mux.Handle("/gophers/count", handleGophersCount())
+	mux.Handle("/gophers/count/reconcile", handleReconcileGophersCount())
 	mux.Handle("/grid", handleGrid())
+	mux.Handle("/auth/login", handleLogin(provider))
+	mux.Handle("/auth/callback", handleAuthCallback(provider))
+	mux.Handle("/auth/logout", handleLogout())
+	mux.Handle("/me/gophers", handleMyGophers())
+	mux.Handle("/me/gophers/json", handleMyGophersAPI())
+	mux.Handle("/me/gophers/{gopherhash}", handleMyGopher())
+	mux.Handle("/roster", handleCreateRoster())
+	mux.Handle("/roster/{slug}/json", handleRosterAPI())
+	mux.Handle("/roster/{slug}/sheet.png", handleRosterSheet())
+	mux.Handle("/roster/{slug}", handleRoster())
+	mux.Handle("/artwork/items", handleUploadArtwork())
+	mux.Handle("/artwork/items/{id:artwork/.+}", handleArtworkItem())
+	mux.Handle("/artwork/categories/{category}", handleArtworkCategory())
+	mux.Handle("/artwork/retired/json", handleRetiredArtwork())
+	mux.Handle("/artwork/collections/json", handleCollections())
+	mux.Handle("/artwork/collections/{collection}", handleCollection())
+	mux.Handle("/artwork/preview/json", handleArtworkPreview())
+	mux.Handle("/keys", handleIssueAPIKey())
+	mux.Handle("/keys/json", handleAPIKeys())
+	mux.Handle("/keys/signing", handleSigningKeys())
+	mux.Handle("/keys/signing/{id}", handleRetireSigningKey())
+	mux.Handle("/keys/sign", handleSignRenderURL())
+	mux.Handle("/keys/{id}", handleRevokeAPIKey())
+	mux.Handle("/admin", handleAdmin())
+	mux.Handle("/admin/gophers/{gopherhash}", handleAdminGopher())
+	mux.Handle("/admin/catalog", handleAdminCatalog())
+	mux.Handle("/admin/catalog/refresh", handleAdminRefresh())
+	mux.Handle("/admin/renders/purge", handleAdminPurgeRenders())
 	mux.Handle("/", server.FileServer("pages/index.html"))
 	http.Handle("/", cors.Default().Handler(mux))
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/appengine/aetest"
+)
+
+// newTestInstance starts a dev app server, skipping the test if the
+// SDK isn't installed.
+func newTestInstance(t *testing.T) aetest.Instance {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Skipf("no dev app server: %s", err)
+	}
+	return inst
+}
+
+// newTestRequest makes a request to the instance, with form as its
+// body if it isn't nil.
+func newTestRequest(t *testing.T, inst aetest.Instance, method, target string, form url.Values, cookies ...*http.Cookie) *http.Request {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	r, err := inst.NewRequest(method, target, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+// serve runs the handler, routed at pattern so it gets its mux vars.
+func serve(pattern string, h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Handle(pattern, h)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// cookie gets the named cookie set by the response.
+func cookie(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie", name)
+	return nil
+}
+
+// signIn signs in with the fake provider, and gets the session cookie.
+func signIn(t *testing.T, inst aetest.Instance) *http.Cookie {
+	provider := fakeProvider{}
+	r := newTestRequest(t, inst, "GET", "/auth/login?return=/me/gophers", nil)
+	w := serve("/auth/login", handleLogin(provider), r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d, want %d", w.Code, http.StatusFound)
+	}
+	state := cookie(t, w, stateCookie)
+	callback, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRequest(t, inst, "GET", "/auth/callback?"+callback.RawQuery, nil, state)
+	w = serve("/auth/callback", handleAuthCallback(provider), r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: got %d, want %d: %s", w.Code, http.StatusFound, w.Body)
+	}
+	if got := w.Header().Get("Location"); got != "/me/gophers" {
+		t.Errorf("callback redirect: got %q, want /me/gophers", got)
+	}
+	return cookie(t, w, sessionCookie)
+}
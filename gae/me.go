@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	savedGopherKind = "SavedGopher"
+)
+
+// SavedGopher is a gopher in a User's collection.
+// Its parent is the User and its key name is the gopher hash.
+// Name, Caption and AltText are the ones the User gave, which are only
+// on the Gopher if they saved it first.
+type SavedGopher struct {
+	Name      string    `datastore:",noindex" json:"name"`
+	Caption   string    `datastore:",noindex" json:"caption,omitempty"`
+	AltText   string    `datastore:",noindex" json:"alt_text,omitempty"`
+	Favourite bool      `json:"favourite"`
+	CTime     time.Time `json:"ctime"`
+	// Gopher is the gopher hash again, so the gopher can be found in
+	// every collection.
+	Gopher string `json:"-"`
+}
+
+// myGopher is a SavedGopher with the gopher it refers to.
+type myGopher struct {
+	SavedGopher
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+// collectGopher adds the gopher to the User's collection, if it isn't
+// there already, with the Name, Caption and AltText in details. Text
+// they give when saving it again replaces what they gave before.
+func collectGopher(ctx context.Context, userID, gopherHash string, details Gopher) error {
+	userKey := datastore.NewKey(ctx, userKind, userID, 0, nil)
+	key := datastore.NewKey(ctx, savedGopherKind, gopherHash, 0, userKey)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var saved SavedGopher
+		err := datastore.Get(ctx, key, &saved)
+		if err == datastore.ErrNoSuchEntity {
+			saved.CTime = time.Now()
+		} else if err != nil {
+			return err
+		} else if !hasDetails(details) {
+			return nil
+		}
+		saved.Name = details.Name
+		saved.Caption = details.Caption
+		saved.AltText = details.AltText
+		saved.Gopher = gopherHash
+		_, err = datastore.Put(ctx, key, &saved)
+		return err
+	}, nil)
+	return errors.Wrap(err, "collect gopher")
+}
+
+// savedGopherKeys gets the keys of the gopher in every collection.
+// Until the saved-gophers backfill has finished, older ones may not
+// have Gopher set, so every key is checked instead.
+func savedGopherKeys(ctx context.Context, gopherHash string) ([]*datastore.Key, error) {
+	done, err := backfillDone(ctx, backfillSavedGophers)
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		keys, err := datastore.NewQuery(savedGopherKind).Filter("Gopher =", gopherHash).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "find SavedGophers")
+		}
+		return keys, nil
+	}
+	var keys []*datastore.Key
+	it := datastore.NewQuery(savedGopherKind).KeysOnly().Run(ctx)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "find SavedGophers")
+		}
+		if key.StringID() == gopherHash {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// myGophers gets the gophers in the User's collection, favourites
+// first and then newest first.
+func myGophers(ctx context.Context, userID string) ([]myGopher, error) {
+	userKey := datastore.NewKey(ctx, userKind, userID, 0, nil)
+	var saved []SavedGopher
+	keys, err := datastore.NewQuery(savedGopherKind).Ancestor(userKey).GetAll(ctx, &saved)
+	if err != nil {
+		return nil, errors.Wrap(err, "load collection")
+	}
+	gopherKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		gopherKeys[i] = datastore.NewKey(ctx, gopherKind, key.StringID(), 0, nil)
+	}
+	gophers := make([]Gopher, len(keys))
+	err = datastore.GetMulti(ctx, gopherKeys, gophers)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return nil, errors.Wrap(err, "load gophers")
+	}
+	mine := make([]myGopher, len(keys))
+	for i, key := range keys {
+		mine[i] = myGopher{
+			SavedGopher:  saved[i],
+			ID:           key.StringID(),
+			Status:       jobDone,
+			URL:          gophers[i].URL,
+			ThumbnailURL: gophers[i].ThumbnailURL,
+		}
+		if merr != nil && merr[i] != nil {
+			// not made yet (or it failed)
+			mine[i].Status = jobPending
+		}
+	}
+	sort.Slice(mine, func(i, j int) bool {
+		if mine[i].Favourite != mine[j].Favourite {
+			return mine[i].Favourite
+		}
+		return mine[i].CTime.After(mine[j].CTime)
+	})
+	return mine, nil
+}
+
+// requireUser gets the signed in User, sending people who aren't
+// signed in to the login page.
+func requireUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	ctx := appengine.NewContext(r)
+	user, err := currentUser(ctx, r)
+	if err != nil {
+		log.Errorf(ctx, "%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if user == nil {
+		if strings.HasSuffix(r.URL.Path, "/json") || r.Method != http.MethodGet {
+			http.Error(w, "sign in required", http.StatusUnauthorized)
+			return nil, false
+		}
+		http.Redirect(w, r, "/auth/login?return="+r.URL.Path, http.StatusFound)
+		return nil, false
+	}
+	return user, true
+}
+
+func handleMyGophers() http.Handler {
+	tpl, err := template.ParseFiles("pages/_layout.html", "pages/me.html")
+	if err != nil {
+		return server.ErrHandler(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		gophers, err := myGophers(ctx, user.ID)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pageInfo := struct {
+			PageURL     string
+			CacheBuster string
+			User        *User
+			Gophers     []myGopher
+		}{
+			PageURL:     "https://gopherize.me/me/gophers",
+			CacheBuster: appengine.VersionID(ctx),
+			User:        user,
+			Gophers:     gophers,
+		}
+		w.Header().Set("Content-Type", "text/html")
+		if err := tpl.ExecuteTemplate(w, "layout", pageInfo); err != nil {
+			log.Errorf(ctx, "template execute: %s", err)
+			server.ErrHandler(err).ServeHTTP(w, r)
+		}
+	})
+}
+
+func handleMyGophersAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		var response struct {
+			Gophers []myGopher `json:"gophers"`
+		}
+		var err error
+		response.Gophers, err = myGophers(ctx, user.ID)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			err = errors.Wrap(err, "encode gophers")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+// handleMyGopher updates a gopher in the User's collection.
+// POST with `name` to rename it, `favourite` (true or false) to change
+// whether it is a favourite, or `delete` to remove it from the
+// collection. DELETE also removes it.
+// The gopher itself is public, so it isn't deleted.
+func handleMyGopher() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		gopherHash := mux.Vars(r)["gopherhash"]
+		userKey := datastore.NewKey(ctx, userKind, user.ID, 0, nil)
+		key := datastore.NewKey(ctx, savedGopherKind, gopherHash, 0, userKey)
+		if r.Method == http.MethodDelete || r.FormValue("delete") != "" {
+			if err := datastore.Delete(ctx, key); err != nil {
+				err = errors.Wrap(err, "delete SavedGopher")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/me/gophers", http.StatusSeeOther)
+			return
+		}
+		name, err := cleanText("name", r.FormValue("name"), maxNameLen)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			var saved SavedGopher
+			if err := datastore.Get(ctx, key, &saved); err != nil {
+				return err
+			}
+			if _, ok := r.Form["name"]; ok {
+				saved.Name = name
+			}
+			if fav := r.FormValue("favourite"); fav != "" {
+				saved.Favourite = fav == "true"
+			}
+			saved.Gopher = gopherHash
+			_, err := datastore.Put(ctx, key, &saved)
+			return err
+		}, nil)
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			err = errors.Wrap(err, "update SavedGopher")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/me/gophers", http.StatusSeeOther)
+	})
+}
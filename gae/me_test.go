@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMyGopher(t *testing.T) {
+	inst := newTestInstance(t)
+	defer inst.Close()
+	session := signIn(t, inst)
+	const gopherHash = "b15efa9350d901705427ce0df2dbc3861d458a76"
+	const userID = "fake:gopher@example.com"
+
+	r := newTestRequest(t, inst, "GET", "/", nil)
+	ctx := appengine.NewContext(r)
+	if err := collectGopher(ctx, userID, gopherHash, Gopher{}); err != nil {
+		t.Fatal(err)
+	}
+	key := datastore.NewKey(ctx, savedGopherKind, gopherHash, 0, datastore.NewKey(ctx, userKind, userID, 0, nil))
+	post := func(form url.Values) {
+		t.Helper()
+		r := newTestRequest(t, inst, "POST", "/me/gophers/"+gopherHash, form, session)
+		w := serve("/me/gophers/{gopherhash}", handleMyGopher(), r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%v: got %d, want %d: %s", form, w.Code, http.StatusSeeOther, w.Body)
+		}
+	}
+
+	post(url.Values{"name": {"Gordon"}})
+	var saved SavedGopher
+	if err := datastore.Get(ctx, key, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Name != "Gordon" {
+		t.Errorf("Name: got %q, want Gordon", saved.Name)
+	}
+
+	post(url.Values{"favourite": {"true"}})
+	if err := datastore.Get(ctx, key, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Favourite {
+		t.Error("not a favourite")
+	}
+	if saved.Name != "Gordon" {
+		t.Errorf("Name changed to %q", saved.Name)
+	}
+
+	mine, err := myGophers(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mine) != 1 || mine[0].ID != gopherHash {
+		t.Fatalf("got %v", mine)
+	}
+
+	post(url.Values{"delete": {"true"}})
+	if err := datastore.Get(ctx, key, &saved); err != datastore.ErrNoSuchEntity {
+		t.Errorf("after delete: got %v, want ErrNoSuchEntity", err)
+	}
+
+	// nor can people who aren't signed in
+	r = newTestRequest(t, inst, "POST", "/me/gophers/"+gopherHash, url.Values{"name": {"Gordon"}})
+	w := serve("/me/gophers/{gopherhash}", handleMyGopher(), r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("signed out: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
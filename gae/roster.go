@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"image"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	rosterKind = "Roster"
+	// maxRosterMembers is the most people a Roster may have.
+	maxRosterMembers = 500
+	// rosterSheetPage is how many members are on each page of the
+	// contact sheet, which keeps the images loaded and drawn for one
+	// request down.
+	rosterSheetPage = 60
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// Roster is a team or organisation and its members' gophers.
+// Its key name is the slug.
+type Roster struct {
+	Slug    string         `datastore:"-" json:"slug"`
+	Name    string         `datastore:",noindex" json:"name"`
+	Members []RosterMember `json:"members"`
+	// Gophers are the members' gophers, so rosters can be found by
+	// gopher.
+	Gophers []string  `json:"-"`
+	Owner   string    `json:"-"` // ID of the User who created it
+	CTime   time.Time `json:"ctime"`
+	MTime   time.Time `json:"mtime"`
+}
+
+// RosterMember is a person in a Roster.
+type RosterMember struct {
+	Name   string `datastore:",noindex" json:"name"`
+	Gopher string `datastore:",noindex" json:"gopher"`
+}
+
+// validate checks and tidies the roster.
+func (r *Roster) validate() error {
+	if len(r.Slug) > 60 || !slugPattern.MatchString(r.Slug) {
+		return errors.New("slug must be lowercase letters, numbers and hyphens")
+	}
+	var err error
+	if r.Name, err = cleanText("name", r.Name, maxNameLen); err != nil {
+		return err
+	}
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(r.Members) > maxRosterMembers {
+		return errors.Errorf("rosters may have at most %d members", maxRosterMembers)
+	}
+	for i := range r.Members {
+		m := &r.Members[i]
+		if m.Name, err = cleanText("member name", m.Name, maxNameLen); err != nil {
+			return err
+		}
+		if !server.IsGopherHash(m.Gopher) {
+			return errors.Errorf("member %q: gopher must be a gopher hash", m.Name)
+		}
+	}
+	r.indexGophers()
+	return nil
+}
+
+// indexGophers sets Gophers from the members.
+func (r *Roster) indexGophers() {
+	r.Gophers = nil
+	seen := make(map[string]bool)
+	for _, m := range r.Members {
+		if !seen[m.Gopher] {
+			seen[m.Gopher] = true
+			r.Gophers = append(r.Gophers, m.Gopher)
+		}
+	}
+}
+
+// rostersWithGopher gets the keys of the rosters with a member whose
+// gopher it is. Older rosters only have Gophers set once the
+// roster-gophers backfill has finished, so until then it gets
+// errRostersNotIndexed rather than loading every roster.
+func rostersWithGopher(ctx context.Context, gopherHash string) ([]*datastore.Key, error) {
+	done, err := backfillDone(ctx, backfillRosterGophers)
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, errRostersNotIndexed
+	}
+	keys, err := datastore.NewQuery(rosterKind).Filter("Gophers =", gopherHash).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "find Rosters")
+	}
+	return keys, nil
+}
+
+// removeRosterGopher takes the members whose gopher it is out of the
+// roster.
+func removeRosterGopher(ctx context.Context, key *datastore.Key, gopherHash string) error {
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var roster Roster
+		if err := datastore.Get(ctx, key, &roster); err != nil {
+			return err
+		}
+		members := roster.Members[:0]
+		for _, m := range roster.Members {
+			if m.Gopher != gopherHash {
+				members = append(members, m)
+			}
+		}
+		roster.Members = members
+		roster.indexGophers()
+		roster.MTime = time.Now()
+		_, err := datastore.Put(ctx, key, &roster)
+		return err
+	}, nil)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return errors.Wrap(err, "save Roster")
+	}
+	purgeRosterSheets(ctx, key.StringID())
+	return nil
+}
+
+// purgeRosterSheets forgets the cached contact sheets of a roster.
+func purgeRosterSheets(ctx context.Context, slug string) {
+	sheetKeys := make([]string, rosterSheetPages(maxRosterMembers))
+	for i := range sheetKeys {
+		sheetKeys[i] = rosterSheetCacheKey(slug, i+1)
+	}
+	memcache.DeleteMulti(ctx, sheetKeys)
+}
+
+func rosterSheetCacheKey(slug string, page int) string {
+	return "roster-sheet:" + slug + ":" + strconv.Itoa(page)
+}
+
+// rosterSheetPages gets how many pages the contact sheet of a roster
+// with n members has.
+func rosterSheetPages(n int) int {
+	return (n + rosterSheetPage - 1) / rosterSheetPage
+}
+
+func loadRoster(ctx context.Context, slug string) (Roster, error) {
+	var roster Roster
+	err := datastore.Get(ctx, datastore.NewKey(ctx, rosterKind, slug, 0, nil), &roster)
+	roster.Slug = slug
+	return roster, err
+}
+
+// handleCreateRoster creates a Roster from the JSON body, owned by the
+// signed in User.
+func handleCreateRoster() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		var roster Roster
+		if err := json.NewDecoder(r.Body).Decode(&roster); err != nil {
+			http.Error(w, errors.Wrap(err, "decode roster").Error(), http.StatusBadRequest)
+			return
+		}
+		if err := roster.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		roster.Owner = user.ID
+		roster.CTime = time.Now()
+		roster.MTime = roster.CTime
+		key := datastore.NewKey(ctx, rosterKind, roster.Slug, 0, nil)
+		errTaken := errors.New("slug is taken")
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			var existing Roster
+			err := datastore.Get(ctx, key, &existing)
+			if err == nil {
+				return errTaken
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			_, err = datastore.Put(ctx, key, &roster)
+			return err
+		}, nil)
+		if err == errTaken {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			err = errors.Wrap(err, "save Roster")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondRoster(ctx, w, http.StatusCreated, roster)
+	})
+}
+
+// handleRosterAPI gets (GET), replaces (PUT) or deletes (DELETE) a
+// Roster. Only its owner may change it.
+func handleRosterAPI() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		slug := mux.Vars(r)["slug"]
+		if r.Method == http.MethodGet {
+			roster, err := loadRoster(ctx, slug)
+			if err == datastore.ErrNoSuchEntity {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				err = errors.Wrap(err, "load roster")
+				log.Errorf(ctx, "%s", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			respondRoster(ctx, w, http.StatusOK, roster)
+			return
+		}
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		var update Roster
+		if r.Method == http.MethodPut {
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				http.Error(w, errors.Wrap(err, "decode roster").Error(), http.StatusBadRequest)
+				return
+			}
+			update.Slug = slug
+			if err := update.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		key := datastore.NewKey(ctx, rosterKind, slug, 0, nil)
+		errForbidden := errors.New("only the owner may change this roster")
+		var roster Roster
+		err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			if err := datastore.Get(ctx, key, &roster); err != nil {
+				return err
+			}
+			if roster.Owner != user.ID {
+				return errForbidden
+			}
+			if r.Method == http.MethodDelete {
+				return datastore.Delete(ctx, key)
+			}
+			roster.Name = update.Name
+			roster.Members = update.Members
+			roster.Gophers = update.Gophers
+			roster.MTime = time.Now()
+			_, err := datastore.Put(ctx, key, &roster)
+			return err
+		}, nil)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			http.NotFound(w, r)
+			return
+		case err == errForbidden:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			err = errors.Wrap(err, "save Roster")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		purgeRosterSheets(ctx, slug)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		roster.Slug = slug
+		respondRoster(ctx, w, http.StatusOK, roster)
+	})
+}
+
+func respondRoster(ctx context.Context, w http.ResponseWriter, status int, roster Roster) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(roster); err != nil {
+		log.Errorf(ctx, "encode roster: %s", err)
+	}
+}
+
+func handleRoster() http.Handler {
+	tpl, err := template.ParseFiles("pages/_layout.html", "pages/roster.html")
+	if err != nil {
+		return server.ErrHandler(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		slug := mux.Vars(r)["slug"]
+		roster, err := loadRoster(ctx, slug)
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			err = errors.Wrap(err, "load roster")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pageInfo := struct {
+			PageURL     string
+			CacheBuster string
+			Roster      Roster
+			SheetPages  []int
+		}{
+			PageURL:     "https://gopherize.me/roster/" + slug,
+			CacheBuster: appengine.VersionID(ctx),
+			Roster:      roster,
+		}
+		for page := 1; page <= rosterSheetPages(len(roster.Members)); page++ {
+			pageInfo.SheetPages = append(pageInfo.SheetPages, page)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		if err := tpl.ExecuteTemplate(w, "layout", pageInfo); err != nil {
+			log.Errorf(ctx, "template execute: %s", err)
+			server.ErrHandler(err).ServeHTTP(w, r)
+		}
+	})
+}
+
+// handleRosterSheet draws the members' gophers, labelled with their
+// names, on a contact sheet of rosterSheetPage members. The `page`
+// query value picks which, starting at 1.
+func handleRosterSheet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		slug := mux.Vars(r)["slug"]
+		page := 1
+		if p := r.URL.Query().Get("page"); p != "" {
+			var err error
+			if page, err = strconv.Atoi(p); err != nil || page < 1 {
+				http.Error(w, "page must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		if item, err := memcache.Get(ctx, rosterSheetCacheKey(slug, page)); err == nil {
+			log.Debugf(ctx, "cache hit: roster sheet %s", slug)
+			respondWithSheet(ctx, w, item.Value)
+			return
+		}
+		roster, err := loadRoster(ctx, slug)
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			err = errors.Wrap(err, "load roster")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(roster.Members) == 0 {
+			http.Error(w, "roster has no members", http.StatusNotFound)
+			return
+		}
+		if page > rosterSheetPages(len(roster.Members)) {
+			http.Error(w, "roster has no such page", http.StatusNotFound)
+			return
+		}
+		members := roster.Members[(page-1)*rosterSheetPage:]
+		if len(members) > rosterSheetPage {
+			members = members[:rosterSheetPage]
+		}
+		hashes := make([]string, len(members))
+		labels := make([]string, len(members))
+		for i, m := range members {
+			hashes[i] = m.Gopher
+			labels[i] = m.Name
+		}
+		images, err := loadGopherImages(ctx, hashes)
+		if err != nil {
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		_, err = server.EncodeSheet(&buf, images, server.SheetOptions{
+			Columns:  6,
+			CellSize: 200,
+			Gutter:   20,
+			Labels:   labels,
+			FontSize: 18,
+		})
+		if err != nil {
+			err = errors.Wrap(err, "draw sheet")
+			log.Errorf(ctx, "%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondWithSheet(ctx, w, buf.Bytes())
+		cacheItem := &memcache.Item{
+			Key:        rosterSheetCacheKey(slug, page),
+			Value:      buf.Bytes(),
+			Expiration: time.Hour,
+		}
+		if err := memcache.Set(ctx, cacheItem); err != nil {
+			log.Warningf(ctx, "memcache set: %s", err)
+		}
+	})
+}
+
+// loadGopherImages loads the saved image of each gopher. Gophers that
+// can't be loaded are nil.
+func loadGopherImages(ctx context.Context, hashes []string) ([]image.Image, error) {
+	names := make([]string, len(hashes))
+	for i, h := range hashes {
+		names[i] = server.GopherObject(h)
+	}
+	images, err := server.LoadImages(ctx, names...)
+	if err != nil {
+		return nil, errors.Wrap(err, "load gophers")
+	}
+	return images, nil
+}
+
+func respondWithSheet(ctx context.Context, w http.ResponseWriter, data []byte) {
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(data); err != nil {
+		log.Warningf(ctx, "write png: %s", err)
+	}
+}
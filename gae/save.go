@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/matryer/gopherize.me/server"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/appengine/blobstore"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/image"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// errPrivateSave is returned for gophers from private packs, which
+// would otherwise become public objects.
+var errPrivateSave = errors.New("gophers from private packs can't be saved - download them instead")
+
+const (
+	// saveLockExpiration is how long a save holds its lock before
+	// other saves of the same gopher stop waiting for it.
+	saveLockExpiration = 30 * time.Second
+	// saveWaitInterval is how often a waiting save checks whether
+	// the gopher has been created.
+	saveWaitInterval = 500 * time.Millisecond
+)
+
+// createGopher gets the gopher at key, rendering, uploading and storing
+// it first if it doesn't exist yet. details holds the Images and the
+// Owner, Name, Caption and AltText given by the person saving it.
+// Concurrent calls for the same key render once; created is true only
+// for the call that stored the entity.
+func createGopher(ctx context.Context, key *datastore.Key, details Gopher) (gopher Gopher, created bool, err error) {
+	pack, err := server.ImagesPack(details.Images, "")
+	if err != nil {
+		return gopher, false, err
+	}
+	if private, err := server.PackPrivate(ctx, pack); err != nil {
+		return gopher, false, errors.Wrap(err, "check pack")
+	} else if private {
+		return gopher, false, errPrivateSave
+	}
+	details.Pack = pack
+	return storeGopher(ctx, key, details, uploadGopher)
+}
+
+// gopherUploader renders and uploads the image of the gopher at key,
+// filling in its URLs. cleanup removes anything it uploaded, and is
+// called if the gopher can't be stored.
+type gopherUploader func(ctx context.Context, key *datastore.Key, gopher *Gopher) (cleanup func(), err error)
+
+// storeGopher does the work of createGopher, using upload to make the
+// image.
+func storeGopher(ctx context.Context, key *datastore.Key, details Gopher, upload gopherUploader) (gopher Gopher, created bool, err error) {
+	err = datastore.Get(ctx, key, &gopher)
+	if err == nil {
+		return gopher, false, nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return gopher, false, errors.Wrap(err, "read Gopher")
+	}
+	lock := &memcache.Item{
+		Key:        "save-lock:" + key.StringID(),
+		Value:      []byte{1},
+		Expiration: saveLockExpiration,
+	}
+	if err := memcache.Add(ctx, lock); err == memcache.ErrNotStored {
+		// someone else is saving this gopher - wait for them
+		log.Debugf(ctx, "waiting for concurrent save: %s", key.StringID())
+		for deadline := time.Now().Add(saveLockExpiration); time.Now().Before(deadline); {
+			time.Sleep(saveWaitInterval)
+			err := datastore.Get(ctx, key, &gopher)
+			if err == nil {
+				return gopher, false, nil
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return gopher, false, errors.Wrap(err, "read Gopher")
+			}
+			if _, err := memcache.Get(ctx, lock.Key); err == memcache.ErrCacheMiss {
+				// they gave up - try ourselves
+				break
+			}
+		}
+	} else if err != nil {
+		log.Warningf(ctx, "memcache add: %s", err)
+	} else {
+		defer memcache.Delete(ctx, lock.Key)
+	}
+
+	gopher = details
+	cleanup, err := upload(ctx, key, &gopher)
+	if err != nil {
+		return gopher, false, err
+	}
+	gopher.CTime = time.Now()
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var existing Gopher
+		err := datastore.Get(ctx, key, &existing)
+		if err == nil {
+			// saved by someone else in the meantime
+			gopher = existing
+			created = false
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := datastore.Put(ctx, key, &gopher); err != nil {
+			return err
+		}
+		created = true
+		return countGopher(ctx, gopher.CTime, 1)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		cleanup()
+		return gopher, false, errors.Wrap(err, "save Gopher")
+	}
+	return gopher, created, nil
+}
+
+// uploadGopher is the gopherUploader that renders the gopher's Images
+// into the bucket, and serves it with the images service.
+func uploadGopher(ctx context.Context, key *datastore.Key, gopher *Gopher) (func(), error) {
+	log.Debugf(ctx, "rendering: %s", gopher.Images)
+	var buf bytes.Buffer
+	if err := server.Render(ctx, &buf, gopher.Images, server.RenderOptions{}); err != nil {
+		return nil, errors.Wrap(err, "rendering")
+	}
+	bucket, err := file.DefaultBucketName(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "DefaultBucketName")
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "storage.NewClient")
+	}
+	objpath := server.GopherObject(key.StringID())
+	object := client.Bucket(bucket).Object(objpath)
+	uploaded, err := uploadOnce(ctx, object, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// cleanup removes the object if this call uploaded it
+	cleanup := func() {
+		if !uploaded {
+			return
+		}
+		if err := object.Delete(ctx); err != nil {
+			log.Warningf(ctx, "delete orphan %s: %s", objpath, err)
+		}
+	}
+
+	blobkey, err := blobstore.BlobKeyForFile(ctx, fmt.Sprintf("/gs/%s/%s", bucket, objpath))
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "BlobKeyForFile")
+	}
+	absURL, err := image.ServingURL(ctx, blobkey, &image.ServingURLOptions{Secure: true})
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "ServingURL (abs)")
+	}
+	thumbURL, err := image.ServingURL(ctx, blobkey, &image.ServingURLOptions{Secure: true, Size: 70})
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "ServingURL (thumb)")
+	}
+	gopher.URL = absURL.String()
+	gopher.ThumbnailURL = thumbURL.String()
+	gopher.OriginalURL = fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, objpath)
+	return cleanup, nil
+}
+
+// uploadOnce writes data to object unless it already exists.
+// uploaded is true if this call created the object.
+// Objects are named by the selection hash rather than by a hash of
+// their content, so sheets and rosters can find them from the gopher
+// hash alone. Saves always render with the default options, so renders
+// of one selection only differ if the artwork changed between them; the
+// first one written is kept, and every save of the selection gets a
+// gopher pointing at it. TestStoreGopherKeepsFirstRender checks this.
+func uploadOnce(ctx context.Context, object *storage.ObjectHandle, data []byte) (uploaded bool, err error) {
+	sum := md5.Sum(data)
+	objW := object.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	objW.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	objW.CacheControl = "public, max-age=31536000"
+	objW.ContentType = "image/png"
+	objW.MD5 = sum[:]
+	if _, err := objW.Write(data); err != nil {
+		objW.Close()
+		return false, errors.Wrap(err, "write object")
+	}
+	if err := objW.Close(); err != nil {
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+			log.Debugf(ctx, "already uploaded: %s", object.ObjectName())
+			if attrs, err := object.Attrs(ctx); err == nil && !bytes.Equal(attrs.MD5, sum[:]) {
+				log.Infof(ctx, "keeping earlier render of %s", object.ObjectName())
+			}
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Close writer")
+	}
+	return true, nil
+}
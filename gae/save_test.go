@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matryer/gopherize.me/server"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestStoreGopherConcurrent(t *testing.T) {
+	inst := newTestInstance(t)
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	images := []string{"artwork/010-Body/blue_gopher.png", "artwork/020-Eyes/crazy_eyes.png"}
+	key := datastore.NewKey(ctx, gopherKind, server.Hash(strings.Join(images, "|")), 0, nil)
+	var uploads, cleanups int32
+	upload := func(ctx context.Context, key *datastore.Key, gopher *Gopher) (func(), error) {
+		atomic.AddInt32(&uploads, 1)
+		gopher.URL = "https://example.com/" + key.StringID()
+		return func() { atomic.AddInt32(&cleanups, 1) }, nil
+	}
+
+	const savers = 8
+	var wg sync.WaitGroup
+	var created int32
+	errs := make(chan error, savers)
+	for i := 0; i < savers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gopher, ok, err := storeGopher(ctx, key, Gopher{Images: images}, upload)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if gopher.URL == "" {
+				t.Error("gopher has no URL")
+			}
+			if ok {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if uploads != 1 {
+		t.Errorf("uploads: got %d, want 1", uploads)
+	}
+	if cleanups != 0 {
+		t.Errorf("cleanups: got %d, want 0", cleanups)
+	}
+	if created != 1 {
+		t.Errorf("created: got %d, want 1", created)
+	}
+	n, err := datastore.NewQuery(gopherKind).KeysOnly().Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Gopher entities: got %d, want 1", n)
+	}
+	total, err := server.Count(ctx, server.CounterGophers, gophersTotal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 {
+		t.Errorf("gophers counter: got %d, want 1", total)
+	}
+}
+
+func TestStoreGopherKeepsFirstRender(t *testing.T) {
+	inst := newTestInstance(t)
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	images := []string{"artwork/010-Body/blue_gopher.png"}
+	key := datastore.NewKey(ctx, gopherKind, server.Hash(strings.Join(images, "|")), 0, nil)
+	// objects stands in for the bucket, which like uploadOnce only
+	// writes an object that doesn't exist yet
+	var mu sync.Mutex
+	objects := map[string]string{}
+	uploadRender := func(render string) gopherUploader {
+		return func(ctx context.Context, key *datastore.Key, gopher *Gopher) (func(), error) {
+			name := server.GopherObject(key.StringID())
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := objects[name]; !ok {
+				objects[name] = render
+			}
+			gopher.OriginalURL = "https://storage.googleapis.com/bucket/" + name
+			return func() {}, nil
+		}
+	}
+
+	first, created, err := storeGopher(ctx, key, Gopher{Images: images}, uploadRender("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("first save didn't create the gopher")
+	}
+	// the artwork changes, and the same selection is saved again
+	again, created, err := storeGopher(ctx, key, Gopher{Images: images}, uploadRender("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("second save created the gopher again")
+	}
+	if again.OriginalURL != first.OriginalURL {
+		t.Errorf("got %s, want the first save's %s", again.OriginalURL, first.OriginalURL)
+	}
+	if got := objects[server.GopherObject(key.StringID())]; got != "first" {
+		t.Errorf("object holds the %s render, want the first", got)
+	}
+}
@@ -19,16 +19,21 @@
 	var artworkResponse = null
 	var artwork = null
 
+	// ?pack= picks an artwork pack other than the default
+	var pack = /[?&]pack=([^&]*)/.exec(location.search)
+	pack = pack ? decodeURIComponent(pack[1]) : ''
+	var packParam = pack ? '&pack=' + encodeURIComponent(pack) : ''
+
 	var selection = []
 
 	function absurl() {
-		return apihost+'render.png?dl=0&images=' + encodeURIComponent(selection.join('|'))
+		return apihost+'render.png?dl=0&images=' + encodeURIComponent(selection.join('|')) + packParam
 	}
 
 	$('#download-button').click(function(){
 		var $this = $(this)
 		$this.attr("disabled", "disabled")
-		location.href = '/api/render.png?images=' + encodeURIComponent(selection.join('|'))
+		location.href = '/api/render.png?images=' + encodeURIComponent(selection.join('|')) + packParam
 	})
 
 	$('#share-button').click(function(){
@@ -50,7 +55,7 @@
 	function loadArtwork(callback) {
 		busy(true)
 		$.ajax({
-			url: apiArtwork,
+			url: apiArtwork + (pack ? '?pack=' + encodeURIComponent(pack) : ''),
 			success: callback,
 			error: function(){
 				console.warn(arguments)
@@ -84,6 +89,18 @@
 		return null
 	}
 
+	// firstFrame gets an element showing src, cropped to its first frame
+	// if the image is a sprite strip
+	function firstFrame(src, image) {
+		var $img = $("<img>", {src: src})
+		if (!(image.frames > 1)) {
+			return $img
+		}
+		return $("<div>", {class: 'frame'}).append(
+			$img.css({position: 'static', width: (image.frames * 100) + '%', maxWidth: 'none'})
+		)
+	}
+
 	function updatePreview() {
 		$("#next-button").prop("disabled", false)
 		var ids = []
@@ -97,7 +114,7 @@
 				ids.push(id)
 				var mt = special ? 0 : -1000
 				previewEl.append(
-					$("<img>", {src: img.href}).css({
+					firstFrame(img.href, img).css({
 						marginTop: -1000
 					})
 				)
@@ -106,7 +123,7 @@
 		})
 		selection = ids
 		var i = 1;
-		previewEl.find("img").each(function(){
+		previewEl.children().each(function(){
 			var $this = $(this)
 			$this.animate({
 				marginTop: 0
@@ -153,7 +170,26 @@
 
 	function next() {
 		$("#next-button").prop("disabled", true)
-		location.href = '/save?images=' + encodeURIComponent(selection.join('|'))
+		// saves are posted with a token that proves they came from this page
+		$.getJSON('/save/token', function(data){
+			var fields = {
+				csrf_token: data.token,
+				images: selection.join('|'),
+				name: $('#gopher-name').val(),
+				caption: $('#gopher-caption').val(),
+				alt: $('#gopher-alt').val()
+			}
+			if (pack) {
+				fields.pack = pack
+			}
+			var $form = $('<form>', {method: 'post', action: '/save'})
+			for (var name in fields) {
+				$form.append($('<input>', {type: 'hidden', name: name, value: fields[name]}))
+			}
+			$form.appendTo('body').submit()
+		}).fail(function(){
+			$("#next-button").prop("disabled", false)
+		})
 	}
 
 	$(function(){
@@ -195,7 +231,7 @@
 
 					$("<label>", {class:'item'}).append(
 						$('<input>', {type:'radio', name:catID, value:image.id, checked: (special && specialInCat ? 'checked' : null)}).change(updatePreview),
-						$('<img>', {src: image.thumbnail_href, 'title':image.name, 'data-toggle':'tooltip', 'data-placement':'bottom'}).tooltip()
+						firstFrame(image.thumbnail_href, image).attr({'title':image.name, 'data-toggle':'tooltip', 'data-placement':'bottom'}).tooltip()
 					).appendTo(list)
 					specialInCat = false
 
@@ -229,6 +265,14 @@
 
 			}
 
+			// ?images= picks a saved selection to edit
+			var edit = /[?&]images=([^&]*)/.exec(location.search)
+			if (edit) {
+				$.each(decodeURIComponent(edit[1].replace(/\+/g, ' ')).split('|'), function(i, id){
+					$('input[value="'+id+'"]').prop('checked', true)
+				})
+			}
+
 			updatePreview()
 
 		})
@@ -1,23 +1,46 @@
 $(function(){
-	var results = null;
 	$("#grid").each(function(){
 		var $this = $(this)
-		$.ajax({
-			url: 'https://gopherize.me/gophers/recent/json?limit=1000',
-			success: function(results){
-				for (var i in results.gophers) {
-					if (!results.gophers.hasOwnProperty(i)) { continue }
-					var gopher = results.gophers[i]
-					$this.append(
-						$('<a>', {href:'/gopher/'+gopher.id}).append(
-							$('<img>', {src: gopher.thumbnail_url})
+		var next = null
+		var loading = false
+		var done = false
+		function load() {
+			if (loading || done) { return }
+			loading = true
+			var url = 'https://gopherize.me/gophers/recent/json?limit=500'
+			if (next) {
+				url += '&cursor=' + encodeURIComponent(next)
+			}
+			$.ajax({
+				url: url,
+				success: function(results){
+					for (var i in results.gophers) {
+						if (!results.gophers.hasOwnProperty(i)) { continue }
+						var gopher = results.gophers[i]
+						$this.append(
+							$('<a>', {href:'/gopher/'+gopher.id}).append(
+								$('<img>', {src: gopher.thumbnail_url})
+							)
 						)
-					)
+					}
+					next = results.next
+					if (!next) {
+						done = true
+					}
+				},
+				error: function(){
+					console.warn(arguments)
+				},
+				complete: function(){
+					loading = false
 				}
-			},
-			error: function(){
-				console.warn(arguments)
+			})
+		}
+		$(window).scroll(function(){
+			if ($(window).scrollTop() + $(window).height() > $(document).height() - 400) {
+				load()
 			}
 		})
+		load()
 	})
-})
\ No newline at end of file
+})
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFrames is the most frames an animated render may have.
+	maxFrames = 48
+	// maxRenderPixels is the most pixels a render may have over all its
+	// frames, which bounds the work and memory it takes.
+	maxRenderPixels = 48 * 1024 * 1024
+	// defaultFrameDelay is the time each frame is shown for, in
+	// milliseconds.
+	defaultFrameDelay = 100
+)
+
+// layer is an artwork item split into its animation frames.
+// Static items have one frame.
+type layer []image.Image
+
+// splitFrames splits any sprite strips in the images into frames the
+// size of the canvas, which comes from the catalog. A sprite strip is an
+// image whose width is a whole multiple of the canvas width; each
+// canvas-sized slice is a frame, from left to right. If the canvas isn't
+// known, the narrowest image is taken to be a single frame.
+func splitFrames(canvas image.Rectangle, images []image.Image) (image.Rectangle, []layer) {
+	if canvas.Empty() {
+		for _, img := range images {
+			if img == nil {
+				continue
+			}
+			b := img.Bounds()
+			if canvas.Empty() || b.Dx() < canvas.Dx() {
+				canvas = image.Rect(0, 0, b.Dx(), b.Dy())
+			}
+		}
+	}
+	layers := make([]layer, len(images))
+	for i, img := range images {
+		if img == nil {
+			continue
+		}
+		layers[i] = splitStrip(img, canvas.Dx())
+	}
+	return canvas, layers
+}
+
+// splitStrip splits img into frames frameWidth wide. Images that aren't
+// a sprite strip are a single frame.
+func splitStrip(img image.Image, frameWidth int) layer {
+	b := img.Bounds()
+	n := b.Dx() / frameWidth
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if n < 2 || b.Dx()%frameWidth != 0 || !ok {
+		return layer{img}
+	}
+	frames := make(layer, n)
+	for f := range frames {
+		x := b.Min.X + f*frameWidth
+		frames[f] = sub.SubImage(image.Rect(x, b.Min.Y, x+frameWidth, b.Max.Y))
+	}
+	return frames
+}
+
+// frameCount gets the number of frames needed for every layer to
+// loop cleanly, up to maxFrames.
+func frameCount(layers []layer) int {
+	n := 1
+	for _, l := range layers {
+		if len(l) < 2 {
+			continue
+		}
+		n = lcm(n, len(l))
+		if n > maxFrames {
+			return maxFrames
+		}
+	}
+	return n
+}
+
+func lcm(a, b int) int {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+// composeFrame stacks frame i of each layer onto the canvas.
+// Layers with fewer frames loop.
+func composeFrame(canvas image.Rectangle, layers []layer, i int) *image.RGBA {
+	output := image.NewRGBA(canvas)
+	for _, l := range layers {
+		if len(l) == 0 {
+			// skip missing images
+			continue
+		}
+		frame := l[i%len(l)]
+		draw.Draw(output, output.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	}
+	return output
+}
+
+// frameEncoder writes an animation a frame at a time, so the frames
+// needn't all be held at full colour.
+type frameEncoder interface {
+	// WriteFrame adds the next frame.
+	WriteFrame(frame *image.RGBA) error
+	// Close finishes the animation.
+	Close() error
+}
+
+// gifEncoder is a frameEncoder for looping animated GIFs, which
+// dithers each frame with Floyd-Steinberg. The paletted frames are
+// kept until Close, as a GIF can only be written whole.
+type gifEncoder struct {
+	w     io.Writer
+	delay int
+	anim  gif.GIF
+}
+
+var gifPalette = append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+
+func (e *gifEncoder) WriteFrame(frame *image.RGBA) error {
+	b := frame.Bounds()
+	paletted := image.NewPaletted(b, gifPalette)
+	draw.FloydSteinberg.Draw(paletted, b, frame, b.Min)
+	e.anim.Image = append(e.anim.Image, paletted)
+	e.anim.Delay = append(e.anim.Delay, e.delay/10)
+	e.anim.Disposal = append(e.anim.Disposal, gif.DisposalBackground)
+	return nil
+}
+
+func (e *gifEncoder) Close() error {
+	if err := gif.EncodeAll(e.w, &e.anim); err != nil {
+		return errors.Wrap(err, "GIF encode")
+	}
+	return nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// writeChunk writes a PNG chunk.
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+	for _, b := range [][]byte{header[:], data, footer[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apngEncoder is a frameEncoder for looping animated PNGs, which
+// writes each frame as it comes.
+type apngEncoder struct {
+	w      io.Writer
+	bounds image.Rectangle
+	delay  int
+	seq    uint32
+	frames int
+}
+
+// newAPNGEncoder writes the header of an animated PNG of n frames the
+// size of bounds. delay is in milliseconds.
+func newAPNGEncoder(w io.Writer, bounds image.Rectangle, n, delay int) (*apngEncoder, error) {
+	if _, err := w.Write(pngSignature); err != nil {
+		return nil, errors.Wrap(err, "APNG encode")
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // truecolour with alpha
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], uint32(n))
+	// zero plays forever
+	chunks := []struct {
+		typ  string
+		data []byte
+	}{{"IHDR", ihdr}, {"acTL", actl}}
+	for _, c := range chunks {
+		if err := writeChunk(w, c.typ, c.data); err != nil {
+			return nil, errors.Wrap(err, "APNG encode")
+		}
+	}
+	return &apngEncoder{w: w, bounds: bounds, delay: delay}, nil
+}
+
+func (e *apngEncoder) WriteFrame(frame *image.RGBA) error {
+	b := e.bounds
+	if frame.Bounds() != b {
+		return errors.New("frames must be the same size")
+	}
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:], e.seq)
+	binary.BigEndian.PutUint32(fctl[4:], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(fctl[8:], uint32(b.Dy()))
+	// x and y offsets are zero
+	binary.BigEndian.PutUint16(fctl[20:], uint16(e.delay))
+	binary.BigEndian.PutUint16(fctl[22:], 1000)
+	fctl[24] = 1 // dispose to background
+	fctl[25] = 0 // replace the frame region
+	e.seq++
+	if err := writeChunk(e.w, "fcTL", fctl); err != nil {
+		return errors.Wrap(err, "APNG encode")
+	}
+	data, err := compressFrame(frame)
+	if err != nil {
+		return errors.Wrap(err, "APNG encode")
+	}
+	if e.frames == 0 {
+		err = writeChunk(e.w, "IDAT", data)
+	} else {
+		fdat := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, e.seq)
+		copy(fdat[4:], data)
+		e.seq++
+		err = writeChunk(e.w, "fdAT", fdat)
+	}
+	if err != nil {
+		return errors.Wrap(err, "APNG encode")
+	}
+	e.frames++
+	return nil
+}
+
+func (e *apngEncoder) Close() error {
+	if err := writeChunk(e.w, "IEND", nil); err != nil {
+		return errors.Wrap(err, "APNG encode")
+	}
+	return nil
+}
+
+// compressFrame gets the zlib compressed, unfiltered, non-premultiplied
+// RGBA scanlines of img.
+func compressFrame(img *image.RGBA) ([]byte, error) {
+	b := img.Bounds()
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]byte, 1+b.Dx()*4)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		// row[0] is the filter type: none
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.RGBAAt(x, y)).(color.NRGBA)
+			i := 1 + (x-b.Min.X)*4
+			row[i], row[i+1], row[i+2], row[i+3] = c.R, c.G, c.B, c.A
+		}
+		if _, err := zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	apiKeyKind = "APIKey"
+	// defaultKeyRate is the requests a minute a key gets unless it
+	// is issued with another rate.
+	defaultKeyRate = 600
+	maxKeyRate     = 60000
+	// apiKeyCacheExpiration is how long keys are cached, so how long
+	// revoking one can take on instances that missed the purge.
+	apiKeyCacheExpiration = 5 * time.Minute
+	// apiKeyDayFormat names the daily usage counters.
+	apiKeyDayFormat = "2006-01-02"
+)
+
+// Counter groups for API key usage, named by key ID, and by key ID and
+// day for the daily counts.
+const (
+	CounterAPIKeyRequests = "apikey.requests"
+	CounterAPIKeyDaily    = "apikey.daily"
+)
+
+// Errors about API keys.
+var (
+	ErrAPIKeyNotFound = errors.New("no such API key")
+	ErrBadAPIKey      = errors.New("invalid or revoked API key")
+)
+
+// apiKeyPattern matches issued keys, which are the key ID, a dot and
+// the secret.
+var apiKeyPattern = regexp.MustCompile(`^([0-9a-f]{12})\.[0-9a-f]{32}$`)
+
+// APIKey is an issued API key. Only the hash of the whole key is
+// stored, so it is shown once when it is issued.
+type APIKey struct {
+	ID    string `datastore:"-" json:"id"`
+	Name  string `json:"name"`
+	Owner string `json:"owner,omitempty"`
+	// Hash is the hex SHA-256 of the key, which can also go in the keys
+	// of a private pack.
+	Hash string `datastore:",noindex" json:"hash"`
+	// Rate is the requests a minute the key may make.
+	Rate    int       `datastore:",noindex" json:"rate"`
+	Revoked bool      `json:"revoked"`
+	CTime   time.Time `json:"ctime"`
+	// Usage and UsageToday count the requests made with the key.
+	Usage      int64 `datastore:"-" json:"usage"`
+	UsageToday int64 `datastore:"-" json:"usage_today"`
+}
+
+// CheckKeyRate checks the requests a minute for a key.
+func CheckKeyRate(rate int) error {
+	if rate < 1 || rate > maxKeyRate {
+		return errors.Errorf("rate must be between 1 and %d requests a minute", maxKeyRate)
+	}
+	return nil
+}
+
+// IssueAPIKey makes and stores a new API key, and gets it along with
+// the key itself. Zero rate means defaultKeyRate.
+func IssueAPIKey(ctx context.Context, name, owner string, rate int) (APIKey, string, error) {
+	if rate == 0 {
+		rate = defaultKeyRate
+	}
+	if err := CheckKeyRate(rate); err != nil {
+		return APIKey{}, "", err
+	}
+	b := make([]byte, 22)
+	if _, err := rand.Read(b); err != nil {
+		return APIKey{}, "", errors.Wrap(err, "make key")
+	}
+	random := hex.EncodeToString(b)
+	k := APIKey{
+		ID:    random[:12],
+		Name:  name,
+		Owner: owner,
+		Rate:  rate,
+		CTime: time.Now(),
+	}
+	secret := k.ID + "." + random[12:]
+	k.Hash = hashKey(secret)
+	key := datastore.NewKey(ctx, apiKeyKind, k.ID, 0, nil)
+	if _, err := datastore.Put(ctx, key, &k); err != nil {
+		return APIKey{}, "", errors.Wrap(err, "put APIKey")
+	}
+	return k, secret, nil
+}
+
+// APIKeys gets every issued key with its usage, newest first.
+func APIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	dskeys, err := datastore.NewQuery(apiKeyKind).Order("-CTime").GetAll(ctx, &keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "load APIKeys")
+	}
+	ids := make([]string, len(keys))
+	for i := range keys {
+		ids[i] = dskeys[i].StringID()
+	}
+	now := time.Now()
+	today := now.Format(apiKeyDayFormat)
+	yesterday := now.AddDate(0, 0, -1).Format(apiKeyDayFormat)
+	pendingToday := pendingAPIKeyUsage(ctx, ids, today)
+	pendingYesterday := pendingAPIKeyUsage(ctx, ids, yesterday)
+	for i := range keys {
+		keys[i].ID = ids[i]
+		if keys[i].Usage, err = Count(ctx, CounterAPIKeyRequests, keys[i].ID); err != nil {
+			return nil, err
+		}
+		if keys[i].UsageToday, err = Count(ctx, CounterAPIKeyDaily, keys[i].ID+":"+today); err != nil {
+			return nil, err
+		}
+		keys[i].Usage += pendingToday[ids[i]] + pendingYesterday[ids[i]]
+		keys[i].UsageToday += pendingToday[ids[i]]
+	}
+	return keys, nil
+}
+
+// apiKeyUsageCacheKey names the memcache count of the requests made
+// with a key on a day that haven't been flushed to its counters.
+func apiKeyUsageCacheKey(id, day string) string {
+	return "apikeyusage:" + id + ":" + day
+}
+
+// recordAPIKeyUse counts a request made with the key in memcache, so
+// requests don't each need a transaction. FlushAPIKeyUsage adds the
+// counts to the key's counters; any that memcache evicts before then
+// are never counted.
+func recordAPIKeyUse(ctx context.Context, id string) {
+	key := apiKeyUsageCacheKey(id, time.Now().Format(apiKeyDayFormat))
+	if _, err := memcache.Increment(ctx, key, 1, 0); err != nil {
+		log.Warningf(ctx, "memcache increment: %s", err)
+	}
+}
+
+// pendingAPIKeyUsage gets the requests made with each key on the day
+// that haven't been flushed, by key ID. Keys without any are left out.
+func pendingAPIKeyUsage(ctx context.Context, ids []string, day string) map[string]int64 {
+	cacheKeys := make([]string, len(ids))
+	for i, id := range ids {
+		cacheKeys[i] = apiKeyUsageCacheKey(id, day)
+	}
+	items, err := memcache.GetMulti(ctx, cacheKeys)
+	if err != nil {
+		log.Warningf(ctx, "memcache get: %s", err)
+	}
+	pending := make(map[string]int64)
+	for i, id := range ids {
+		item, ok := items[cacheKeys[i]]
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil && n > 0 {
+			pending[id] = n
+		}
+	}
+	return pending
+}
+
+// FlushAPIKeyUsage moves the usage counted in memcache today and
+// yesterday into the counters of every key. It should run every few
+// minutes, and not twice at once.
+func FlushAPIKeyUsage(ctx context.Context) error {
+	dskeys, err := datastore.NewQuery(apiKeyKind).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "load APIKeys")
+	}
+	ids := make([]string, len(dskeys))
+	for i, key := range dskeys {
+		ids[i] = key.StringID()
+	}
+	now := time.Now()
+	for _, day := range []string{now.AddDate(0, 0, -1).Format(apiKeyDayFormat), now.Format(apiKeyDayFormat)} {
+		for id, n := range pendingAPIKeyUsage(ctx, ids, day) {
+			cacheKey := apiKeyUsageCacheKey(id, day)
+			// take off only what is counted, so requests made meanwhile
+			// are left for the next flush
+			if _, err := memcache.IncrementExisting(ctx, cacheKey, -n); err != nil {
+				log.Warningf(ctx, "memcache decrement: %s", err)
+				continue
+			}
+			if err := Increment(ctx, CounterAPIKeyRequests, id, n); err != nil {
+				// put it back for the next flush
+				if _, merr := memcache.Increment(ctx, cacheKey, n, 0); merr != nil {
+					log.Warningf(ctx, "memcache increment: %s", merr)
+				}
+				return err
+			}
+			if err := Increment(ctx, CounterAPIKeyDaily, id+":"+day, n); err != nil {
+				// the total has it, so only the day is short
+				log.Warningf(ctx, "%s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// RevokeAPIKey stops a key working.
+func RevokeAPIKey(ctx context.Context, id string) error {
+	key := datastore.NewKey(ctx, apiKeyKind, id, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var k APIKey
+		if err := datastore.Get(ctx, key, &k); err != nil {
+			return err
+		}
+		k.Revoked = true
+		_, err := datastore.Put(ctx, key, &k)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "revoke APIKey")
+	}
+	if err := memcache.Delete(ctx, apiKeyCacheKey(id)); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "memcache delete: %s", err)
+	}
+	return nil
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyCacheKey(id string) string {
+	return "apikey:" + id
+}
+
+// lookupAPIKey gets the issued key, or ErrBadAPIKey if it isn't one or
+// has been revoked.
+func lookupAPIKey(ctx context.Context, secret string) (APIKey, error) {
+	var k APIKey
+	id, ok := apiKeyID(secret)
+	if !ok {
+		return k, ErrBadAPIKey
+	}
+	if _, err := memcache.Gob.Get(ctx, apiKeyCacheKey(id), &k); err != nil {
+		err := datastore.Get(ctx, datastore.NewKey(ctx, apiKeyKind, id, 0, nil), &k)
+		if err == datastore.ErrNoSuchEntity {
+			return k, ErrBadAPIKey
+		}
+		if err != nil {
+			return k, errors.Wrap(err, "load APIKey")
+		}
+		item := &memcache.Item{
+			Key:        apiKeyCacheKey(id),
+			Object:     k,
+			Expiration: apiKeyCacheExpiration,
+		}
+		if err := memcache.Gob.Set(ctx, item); err != nil {
+			log.Warningf(ctx, "memcache set: %s", err)
+		}
+	}
+	k.ID = id
+	return k, checkAPIKey(k, secret)
+}
+
+// apiKeyID gets the ID of an issued key, or false if secret isn't one.
+func apiKeyID(secret string) (string, bool) {
+	m := apiKeyPattern.FindStringSubmatch(secret)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// checkAPIKey checks secret is the key k was issued as, and that it
+// hasn't been revoked.
+func checkAPIKey(k APIKey, secret string) error {
+	if k.Revoked || subtle.ConstantTimeCompare([]byte(hashKey(secret)), []byte(k.Hash)) != 1 {
+		return ErrBadAPIKey
+	}
+	return nil
+}
+
+// client is who a request is rate limited as.
+type client struct {
+	// bucket names the token bucket.
+	bucket string
+	// rate is in requests a minute.
+	rate  int
+	burst int
+}
+
+// client works out who the request is from, and counts the use of its
+// API key. Keys that aren't issued keys, such as private pack keys,
+// count as no key. It responds and returns false if the key is bad.
+func (s server) client(ctx context.Context, w http.ResponseWriter, r *http.Request) (client, bool) {
+	secret := requestKey(r)
+	if !apiKeyPattern.MatchString(secret) {
+		return client{
+			bucket: "ip:" + ClientIP(r),
+			rate:   anonymousRate,
+			burst:  anonymousBurst,
+		}, true
+	}
+	k, err := lookupAPIKey(ctx, secret)
+	if err == ErrBadAPIKey {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return client{}, false
+	}
+	if err != nil {
+		log.Errorf(ctx, "%s", err)
+		http.Error(w, "Failed to check API key", http.StatusInternalServerError)
+		return client{}, false
+	}
+	recordAPIKeyUse(ctx, k.ID)
+	burst := k.Rate / 6
+	if burst < 1 {
+		burst = 1
+	}
+	return client{bucket: "key:" + k.ID, rate: k.Rate, burst: burst}, true
+}
+
+// take takes n tokens from the client's bucket, one for each image a
+// request renders. It responds with Too Many Requests and returns false
+// if there isn't one. Stores that fail let the request through.
+func (s server) take(ctx context.Context, w http.ResponseWriter, c client, n int) bool {
+	if s.rates == nil {
+		return true
+	}
+	wait, err := s.rates.Take(ctx, c.bucket, float64(c.rate)/60, c.burst, n)
+	if err != nil {
+		log.Warningf(ctx, "rate limit: %s", err)
+		return true
+	}
+	if wait == 0 {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests - please slow down", http.StatusTooManyRequests)
+	return false
+}
+
+// ClientIP gets the IP address of the client, as given by App Engine.
+func ClientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Appengine-User-Ip"); ip != "" {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return strings.TrimSpace(r.RemoteAddr)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyID(t *testing.T) {
+	tests := []struct {
+		secret string
+		id     string
+		ok     bool
+	}{
+		{"0123456789ab.0123456789abcdef0123456789abcdef", "0123456789ab", true},
+		{"", "", false},
+		{"0123456789ab", "", false},
+		{"0123456789AB.0123456789abcdef0123456789abcdef", "", false},
+		{"0123456789ab.0123456789abcdef0123456789abcde", "", false},
+		{"0123456789ab.0123456789abcdef0123456789abcdef0", "", false},
+		{"0123456789ab-0123456789abcdef0123456789abcdef", "", false},
+		// private pack keys aren't issued keys
+		{"letmein", "", false},
+	}
+	for _, test := range tests {
+		id, ok := apiKeyID(test.secret)
+		if id != test.id || ok != test.ok {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.secret, id, ok, test.id, test.ok)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	const secret = "0123456789ab.0123456789abcdef0123456789abcdef"
+	h := hashKey(secret)
+	if len(h) != 64 || strings.Trim(h, "0123456789abcdef") != "" {
+		t.Errorf("got %q, want 64 hex digits", h)
+	}
+	if hashKey(secret) != h {
+		t.Error("hash changed")
+	}
+	if hashKey(secret[:len(secret)-1]+"e") == h {
+		t.Error("different keys have the same hash")
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	const secret = "0123456789ab.0123456789abcdef0123456789abcdef"
+	const other = "0123456789ab.fedcba9876543210fedcba9876543210"
+	k := APIKey{ID: "0123456789ab", Hash: hashKey(secret)}
+	revoked := k
+	revoked.Revoked = true
+	tests := []struct {
+		name   string
+		key    APIKey
+		secret string
+		want   error
+	}{
+		{"issued", k, secret, nil},
+		{"wrong secret", k, other, ErrBadAPIKey},
+		{"revoked", revoked, secret, ErrBadAPIKey},
+		{"no hash", APIKey{ID: k.ID}, secret, ErrBadAPIKey},
+		{"hash as key", k, k.Hash, ErrBadAPIKey},
+	}
+	for _, test := range tests {
+		if err := checkAPIKey(test.key, test.secret); err != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
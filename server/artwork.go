@@ -1,25 +1,50 @@
 package server
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 	"google.golang.org/api/iterator"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/blobstore"
-	"google.golang.org/appengine/file"
 	"google.golang.org/appengine/image"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
+// Artwork lifecycle states. Items that aren't active are left out of
+// the picker but still render, so saved gophers keep working.
+const (
+	StateActive  = "active"
+	StateHidden  = "hidden"
+	StateRetired = "retired"
+)
+
 type artworkResponse struct {
+	// Pack is the ID of the pack, which is empty for the default.
+	Pack              string     `json:"pack,omitempty"`
 	Categories        []Category `json:"categories"`
 	TotalCombinations int        `json:"total_combinations"`
+	// Version changes whenever artwork is added, changed or removed.
+	Version string `json:"version"`
+	// Private is whether the pack is private.
+	Private bool `json:"private,omitempty"`
+	// Width and Height are the size of the artwork, which is the size
+	// of each frame of a sprite strip.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// Collections is the schedule of the collections.
+	Collections []Collection `json:"-"`
+	// Config is the pack's configuration.
+	Config PackConfig `json:"-"`
 }
 
 type Category struct {
@@ -33,62 +58,89 @@ type Image struct {
 	Name          string `json:"name"`
 	Href          string `json:"href"`
 	ThumbnailHref string `json:"thumbnail_href"`
+	// Artist and License come from the object's artist and license
+	// metadata.
+	Artist  string `json:"artist,omitempty"`
+	License string `json:"license,omitempty"`
+	// State is the lifecycle state from the object's state metadata.
+	State string `json:"state,omitempty"`
+	// Collection is the scheduled collection from the object's
+	// collection metadata, if it's in one.
+	Collection string `json:"collection,omitempty"`
+	// Frames is how many frames a sprite strip has, or zero for a
+	// still item.
+	Frames int `json:"frames,omitempty"`
 }
 
 func (s server) artworkHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	s.serveArtwork(w, r, time.Now())
+}
+
+// AllArtwork gets every artwork item in the default pack, whatever its
+// state.
+func AllArtwork(ctx context.Context) ([]Category, error) {
+	res, err := loadArtwork(ctx, "", true)
+	if err != nil {
+		return nil, err
+	}
+	return res.Categories, nil
+}
 
+// loadArtwork lists all the artwork in the pack, from the cache if
+// useCache is set and it's there.
+func loadArtwork(ctx context.Context, pack string, useCache bool) (artworkResponse, error) {
 	var res artworkResponse
+	cacheKey := artworkCacheKey(pack)
 
-	if len(r.URL.Query().Get("nocache")) == 0 {
-		_, err := memcache.Gob.Get(ctx, "artwork", &res)
+	if useCache {
+		_, err := memcache.Gob.Get(ctx, cacheKey, &res)
 		if err == nil {
 			// exit early - from cache
 			log.Debugf(ctx, "cache hit")
-			s.respond(ctx, w, r, http.StatusOK, res)
-			return
+			return res, nil
 		}
 		log.Debugf(ctx, "cache miss - generating artwork data")
 	} else {
 		log.Debugf(ctx, "skipping cache - generating artwork data")
 	}
 
-	bucket, err := file.DefaultBucketName(ctx)
+	bucket, err := Bucket(ctx)
 	if err != nil {
-		s.responderr(ctx, w, r, http.StatusInternalServerError, err)
-		return
+		return res, err
 	}
-	client, err := storage.NewClient(ctx)
+	prefix := packPrefix(pack)
+	objects, err := listArtwork(ctx, bucket, prefix)
 	if err != nil {
-		s.responderr(ctx, w, r, http.StatusInternalServerError, err)
-		return
+		return res, err
 	}
-	q := &storage.Query{
-		Prefix: "artwork",
-	}
-	var objects []*storage.ObjectAttrs
-	bucketlist := client.Bucket(bucket).Objects(ctx, q)
-	for {
-		obj, err := bucketlist.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			s.responderr(ctx, w, r, http.StatusInternalServerError, err)
-			return
-		}
-		objects = append(objects, obj)
+	config, err := readPackConfig(ctx, bucket, pack)
+	if err != nil {
+		return res, err
 	}
 	var categorykeys []string
 	categories := make(map[string]*Category)
+	var collections []Collection
 	for _, object := range objects {
-		if object.ContentType != "image/png" {
+		if object.Name == prefix+collectionsFile {
+			if collections, err = readCollections(ctx, bucket, pack); err != nil {
+				return res, err
+			}
+			continue
+		}
+		if object.Name == prefix+packConfigFile {
+			continue
+		}
+		if object.ContentType != "image/png" && object.ContentType != svgContentType {
+			continue
+		}
+		if isVariant(object.Name) {
+			// high resolution versions are only used for rendering
 			continue
 		}
-		name := strings.TrimPrefix(object.Name, "artwork/")
+		name := strings.TrimPrefix(object.Name, prefix)
 		imageName := nicename(name)
 		publicURL := fmt.Sprintf("https://storage.googleapis.com/%s/%s", object.Bucket, object.Name)
-		catsegs := strings.Split(path.Dir(object.Name), "-")
+		catsegs := strings.Split(path.Dir(name), "-")
 		if len(catsegs) != 2 {
 			continue // skip
 		}
@@ -105,18 +157,14 @@ func (s server) artworkHandler(w http.ResponseWriter, r *http.Request) {
 
 		// get thumbnail URL
 		thumbURL := publicURL
-		if blobkey, err := blobstore.BlobKeyForFile(ctx, "/gs/"+object.Bucket+"/"+object.Name); err == nil {
-			serveURL, err := image.ServingURL(ctx, blobkey, &image.ServingURLOptions{
-				Secure: true,
-				Size:   71,
-			})
-			if err == nil {
-				thumbURL = serveURL.String()
-			} else {
-				log.Warningf(ctx, "image.ServingURL: %s", err)
-			}
-		} else {
-			log.Warningf(ctx, "blobstore.BlobKeyForFile: %s", err)
+		if config.Private {
+			// private artwork isn't public in the bucket, so it is
+			// shown through the render API
+			publicURL = privateRenderURL(object.Name, pack, 0)
+			thumbURL = privateRenderURL(object.Name, pack, 71)
+		} else if object.ContentType != svgContentType {
+			// the image service can't resize SVGs, which scale anyway
+			thumbURL = thumbnailURL(ctx, object, publicURL)
 		}
 
 		category.Images = append(category.Images, Image{
@@ -124,6 +172,10 @@ func (s server) artworkHandler(w http.ResponseWriter, r *http.Request) {
 			Name:          imageName,
 			Href:          publicURL,
 			ThumbnailHref: thumbURL,
+			Artist:        object.Metadata["artist"],
+			License:       object.Metadata["license"],
+			State:         state(object),
+			Collection:    object.Metadata["collection"],
 		})
 	}
 	var orderedCats []Category
@@ -131,24 +183,208 @@ func (s server) artworkHandler(w http.ResponseWriter, r *http.Request) {
 		orderedCats = append(orderedCats, *categories[cat])
 	}
 	res = artworkResponse{
-		Categories: orderedCats,
-	}
-
-	// calculate total number of combinations
-	res.TotalCombinations = 1
-	for _, cat := range res.Categories {
-		res.TotalCombinations *= len(cat.Images) + 1
+		Pack:        pack,
+		Categories:  orderedCats,
+		Version:     catalogVersion(objects),
+		Private:     config.Private,
+		Collections: collections,
+		Config:      config,
 	}
+	setFrames(ctx, bucket, &res)
 
 	cacheItem := &memcache.Item{
-		Key:        "artwork",
+		Key:        cacheKey,
 		Object:     res,
-		Expiration: 24 * time.Hour,
+		Expiration: cacheExpiration(collections, time.Now()),
 	}
 	if err := memcache.Gob.Set(ctx, cacheItem); err != nil {
 		log.Warningf(ctx, "memcache set: %s", err)
 	}
-	s.respond(ctx, w, r, http.StatusOK, res)
+	return res, nil
+}
+
+// setFrames works out the size of the artwork and how many frames each
+// item has. The size comes from the pack config, or else the narrowest
+// item, which is a single frame unless every item is a strip. Items are
+// only read as far as their size.
+func setFrames(ctx context.Context, bucket *storage.BucketHandle, res *artworkResponse) {
+	var images []*Image
+	var names []string
+	for c := range res.Categories {
+		for i := range res.Categories[c].Images {
+			img := &res.Categories[c].Images[i]
+			images = append(images, img)
+			names = append(names, img.ID)
+		}
+	}
+	reads := readConfigs(ctx, bucket, names)
+	width, height := res.Config.Width, res.Config.Height
+	for i, read := range reads {
+		if read.err != nil {
+			log.Warningf(ctx, "read %s: %s", names[i], read.err)
+			continue
+		}
+		if res.Config.Width == 0 && (width == 0 || read.conf.Width < width) {
+			width, height = read.conf.Width, read.conf.Height
+		}
+	}
+	if width <= 0 || height <= 0 {
+		return
+	}
+	res.Width, res.Height = width, height
+	for i, img := range images {
+		if n := reads[i].conf.Width / width; n > 1 && reads[i].conf.Width%width == 0 {
+			img.Frames = n
+		}
+	}
+}
+
+// catalogVersion gets the version of the catalog made from the
+// objects, which changes whenever any of them does.
+func catalogVersion(objects []*storage.ObjectAttrs) string {
+	version := sha1.New()
+	for _, object := range objects {
+		fmt.Fprintf(version, "%s@%d\n", object.Name, object.Generation)
+	}
+	return fmt.Sprintf("%x", version.Sum(nil))[:12]
+}
+
+// state gets the lifecycle state of the object.
+func state(object *storage.ObjectAttrs) string {
+	if s := object.Metadata["state"]; s != "" {
+		return s
+	}
+	return StateActive
+}
+
+// picker gets the artwork people may choose from at the time at,
+// which is the active items that aren't in a collection or are in one
+// whose window is open.
+func (res artworkResponse) picker(at time.Time) artworkResponse {
+	open := make(map[string]bool)
+	for _, c := range res.Collections {
+		open[c.Name] = c.contains(at)
+	}
+	picker := artworkResponse{
+		Pack:    res.Pack,
+		Version: res.Version,
+		Private: res.Private,
+		Width:   res.Width,
+		Height:  res.Height,
+	}
+	for _, cat := range res.Categories {
+		var images []Image
+		for _, img := range cat.Images {
+			if img.State != StateActive && img.State != "" {
+				continue
+			}
+			if img.Collection != "" && !open[img.Collection] {
+				continue
+			}
+			images = append(images, img)
+		}
+		if len(images) == 0 {
+			continue
+		}
+		cat.Images = images
+		picker.Categories = append(picker.Categories, cat)
+	}
+
+	// calculate total number of combinations
+	picker.TotalCombinations = 1
+	for _, cat := range picker.Categories {
+		picker.TotalCombinations *= len(cat.Images) + 1
+	}
+	return picker
+}
+
+// Errors about selections.
+var (
+	ErrEmptySelection     = errors.New("pick some artwork first")
+	ErrArtworkUnavailable = errors.New("that artwork isn't available")
+	ErrSameCategory       = errors.New("only one item from each category may be picked")
+)
+
+// CheckSelection checks every item in the selection is one people may
+// pick from the pack right now, with at most one from each category.
+func CheckSelection(ctx context.Context, images []string, pack string) error {
+	res, err := loadArtwork(ctx, pack, true)
+	if err != nil {
+		return err
+	}
+	picker := res.picker(time.Now())
+	categories := make(map[string]string)
+	for _, cat := range picker.Categories {
+		for _, img := range cat.Images {
+			categories[img.ID] = cat.ID
+		}
+	}
+	picked := make(map[string]bool)
+	for _, id := range images {
+		if id == "" {
+			continue
+		}
+		cat, ok := categories[id]
+		if !ok {
+			return ErrArtworkUnavailable
+		}
+		if picked[cat] {
+			return ErrSameCategory
+		}
+		picked[cat] = true
+	}
+	if len(picked) == 0 {
+		return ErrEmptySelection
+	}
+	return nil
+}
+
+// image gets the item with the ID, or false if there isn't one.
+func (res artworkResponse) image(id string) (Image, bool) {
+	for _, cat := range res.Categories {
+		for _, img := range cat.Images {
+			if img.ID == id {
+				return img, true
+			}
+		}
+	}
+	return Image{}, false
+}
+
+// listArtwork lists every object under the prefix.
+func listArtwork(ctx context.Context, bucket *storage.BucketHandle, prefix string) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	bucketlist := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		obj, err := bucketlist.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// thumbnailURL gets a serving URL for a small version of the object,
+// or fallback if there isn't one.
+func thumbnailURL(ctx context.Context, object *storage.ObjectAttrs, fallback string) string {
+	blobkey, err := blobstore.BlobKeyForFile(ctx, "/gs/"+object.Bucket+"/"+object.Name)
+	if err != nil {
+		log.Warningf(ctx, "blobstore.BlobKeyForFile: %s", err)
+		return fallback
+	}
+	serveURL, err := image.ServingURL(ctx, blobkey, &image.ServingURLOptions{
+		Secure: true,
+		Size:   71,
+	})
+	if err != nil {
+		log.Warningf(ctx, "image.ServingURL: %s", err)
+		return fallback
+	}
+	return serveURL.String()
 }
 
 func nicename(s string) string {
@@ -161,3 +397,20 @@ func nicename(s string) string {
 	}
 	return name
 }
+
+func (s server) artworkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 || limit > 1000 {
+		limit = 100
+	}
+	var res struct {
+		Items []CounterTotal `json:"items"`
+	}
+	res.Items, err = Top(ctx, CounterArtwork, limit)
+	if err != nil {
+		s.responderr(ctx, w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.respond(ctx, w, r, http.StatusOK, res)
+}
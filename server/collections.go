@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+const (
+	// collectionsFile holds the schedule of a pack's collections. It
+	// sits with the artwork so changing it changes the catalog version.
+	collectionsFile = "collections.json"
+	// maxCacheTime is how long the catalog is cached when no schedule
+	// boundary comes sooner.
+	maxCacheTime = 24 * time.Hour
+)
+
+// ErrCollectionNotFound is returned for a collection that isn't in
+// the schedule.
+var ErrCollectionNotFound = errors.New("no such collection")
+
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,40}$`)
+
+// Collection is a group of artwork items, such as holiday hats, that
+// are only in the picker from Start until End. Either may be zero to
+// leave that side open. Items join a collection with their collection
+// metadata; those in a collection that isn't scheduled aren't shown.
+type Collection struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// contains gets whether t is inside the collection's window.
+func (c Collection) contains(t time.Time) bool {
+	if !c.Start.IsZero() && t.Before(c.Start) {
+		return false
+	}
+	if !c.End.IsZero() && !t.Before(c.End) {
+		return false
+	}
+	return true
+}
+
+// CheckCollection checks the name and window of a collection.
+func CheckCollection(c Collection) error {
+	if !collectionNamePattern.MatchString(c.Name) {
+		return errors.New("collection names must be letters, numbers and underscores")
+	}
+	if !c.Start.IsZero() && !c.End.IsZero() && !c.End.After(c.Start) {
+		return errors.New("end must be after start")
+	}
+	return nil
+}
+
+// Collections gets the schedule of the default pack, which is the one
+// that is managed.
+func Collections(ctx context.Context) ([]Collection, error) {
+	res, err := loadArtwork(ctx, "", true)
+	if err != nil {
+		return nil, err
+	}
+	return res.Collections, nil
+}
+
+// SetCollection adds a collection to the schedule, or changes the
+// window of one already there.
+func SetCollection(ctx context.Context, c Collection) error {
+	if err := CheckCollection(c); err != nil {
+		return err
+	}
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return err
+	}
+	collections, err := readCollections(ctx, bucket, "")
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range collections {
+		if collections[i].Name == c.Name {
+			collections[i] = c
+			found = true
+		}
+	}
+	if !found {
+		collections = append(collections, c)
+	}
+	if err := writeCollections(ctx, bucket, "", collections); err != nil {
+		return err
+	}
+	return RefreshArtwork(ctx)
+}
+
+// DeleteCollection takes a collection off the schedule. Its items stay
+// out of the picker until they are put in another collection or taken
+// out of it.
+func DeleteCollection(ctx context.Context, name string) error {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return err
+	}
+	collections, err := readCollections(ctx, bucket, "")
+	if err != nil {
+		return err
+	}
+	var kept []Collection
+	for _, c := range collections {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(collections) {
+		return ErrCollectionNotFound
+	}
+	if err := writeCollections(ctx, bucket, "", kept); err != nil {
+		return err
+	}
+	return RefreshArtwork(ctx)
+}
+
+// SetArtworkCollection puts an item in a collection, or takes it out
+// of its collection if collection is empty.
+func SetArtworkCollection(ctx context.Context, id, collection string) error {
+	if err := checkScheduled(ctx, collection); err != nil {
+		return err
+	}
+	return updateArtwork(ctx, func(o *storage.ObjectAttrs) bool {
+		return o.Name == id
+	}, "collection", collection)
+}
+
+// SetCategoryCollection puts every item in a category in a collection,
+// or takes them out if collection is empty.
+func SetCategoryCollection(ctx context.Context, category, collection string) error {
+	if err := checkScheduled(ctx, collection); err != nil {
+		return err
+	}
+	return updateArtwork(ctx, func(o *storage.ObjectAttrs) bool {
+		return categoryName(o.Name) == category
+	}, "collection", collection)
+}
+
+// checkScheduled checks the collection is in the schedule, unless it
+// is empty.
+func checkScheduled(ctx context.Context, collection string) error {
+	if collection == "" {
+		return nil
+	}
+	collections, err := Collections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range collections {
+		if c.Name == collection {
+			return nil
+		}
+	}
+	return ErrCollectionNotFound
+}
+
+// readCollections reads the pack's schedule from the bucket. There is
+// none if the object doesn't exist.
+func readCollections(ctx context.Context, bucket *storage.BucketHandle, pack string) ([]Collection, error) {
+	r, err := bucket.Object(packPrefix(pack) + collectionsFile).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read collections")
+	}
+	defer r.Close()
+	var collections []Collection
+	if err := json.NewDecoder(r).Decode(&collections); err != nil {
+		return nil, errors.Wrap(err, "decode collections")
+	}
+	return collections, nil
+}
+
+func writeCollections(ctx context.Context, bucket *storage.BucketHandle, pack string, collections []Collection) error {
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].Name < collections[j].Name
+	})
+	w := bucket.Object(packPrefix(pack) + collectionsFile).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if err := json.NewEncoder(w).Encode(collections); err != nil {
+		w.Close()
+		return errors.Wrap(err, "write collections")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "write collections")
+	}
+	return nil
+}
+
+// nextBoundary gets the first time after t that a collection starts
+// or ends, or zero if none does.
+func nextBoundary(collections []Collection, t time.Time) time.Time {
+	var next time.Time
+	for _, c := range collections {
+		for _, b := range []time.Time{c.Start, c.End} {
+			if b.After(t) && (next.IsZero() || b.Before(next)) {
+				next = b
+			}
+		}
+	}
+	return next
+}
+
+// cacheExpiration gets how long the catalog may be cached from now,
+// which is until the next schedule boundary or maxCacheTime.
+func cacheExpiration(collections []Collection, now time.Time) time.Duration {
+	next := nextBoundary(collections, now)
+	if next.IsZero() {
+		return maxCacheTime
+	}
+	d := next.Sub(now)
+	if d > maxCacheTime {
+		return maxCacheTime
+	}
+	if d < time.Second {
+		// zero would mean never expire
+		return time.Second
+	}
+	return d
+}
+
+// ServeArtwork responds with the artwork in the picker at the time at,
+// so admins can preview the schedule. It doesn't check who is asking,
+// so private packs need an API key.
+func ServeArtwork(w http.ResponseWriter, r *http.Request, at time.Time) {
+	server{}.serveArtwork(w, r, at)
+}
+
+// serveArtwork responds with the artwork in the picker at the time at,
+// from the pack in the pack parameter.
+func (s server) serveArtwork(w http.ResponseWriter, r *http.Request, at time.Time) {
+	ctx := appengine.NewContext(r)
+	pack := r.URL.Query().Get("pack")
+	if err := CheckPack(pack); err != nil {
+		s.responderr(ctx, w, r, http.StatusBadRequest, err)
+		return
+	}
+	private, err := s.checkPack(ctx, r, pack)
+	if err == ErrPrivatePack {
+		s.responderr(ctx, w, r, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		s.responderr(ctx, w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if private {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	res, err := loadArtwork(ctx, pack, len(r.URL.Query().Get("nocache")) == 0)
+	if err != nil {
+		s.responderr(ctx, w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.respond(ctx, w, r, http.StatusOK, res.picker(at))
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	counterShardKind = "CounterShard"
+	// counterShards is the number of shards each counter is split
+	// across, to avoid contention on a single entity.
+	counterShards = 20
+	// countCacheExpiration is how long counter totals are cached.
+	countCacheExpiration = time.Minute
+)
+
+// Counter groups.
+const (
+	CounterGopherViews     = "gopher.views"
+	CounterGopherDownloads = "gopher.downloads"
+	CounterGopherSaves     = "gopher.saves"
+	CounterArtwork         = "artwork"
+	CounterGophers         = "gophers"
+	CounterGophersDaily    = "gophers.daily"
+)
+
+type counterShard struct {
+	Group string
+	Name  string
+	Count int64
+}
+
+// CounterTotal is the total for a single named counter.
+type CounterTotal struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+func counterCacheKey(group, name string) string {
+	return "counter:" + group + ":" + name
+}
+
+// Increment adds delta to the named counter in group.
+// A random shard is updated in its own transaction.
+func Increment(ctx context.Context, group, name string, delta int64) error {
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		return IncrementInTransaction(ctx, group, name, delta)
+	}, nil)
+	if err != nil {
+		return errors.Wrap(err, "increment "+group)
+	}
+	if _, err := memcache.IncrementExisting(ctx, counterCacheKey(group, name), delta); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "memcache increment: %s", err)
+	}
+	return nil
+}
+
+// IncrementInTransaction adds delta to a random shard of the named
+// counter using ctx, which must be a transaction context (with XG set if
+// it touches other entity groups).
+// The cached total is not updated, so Count may lag by up to
+// countCacheExpiration.
+func IncrementInTransaction(ctx context.Context, group, name string, delta int64) error {
+	key := shardKey(ctx, group, name, rand.Intn(counterShards))
+	var s counterShard
+	err := datastore.Get(ctx, key, &s)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	s.Group = group
+	s.Name = name
+	s.Count += delta
+	_, err = datastore.Put(ctx, key, &s)
+	return err
+}
+
+func shardKey(ctx context.Context, group, name string, shard int) *datastore.Key {
+	return datastore.NewKey(ctx, counterShardKind, fmt.Sprintf("%s:%s:%d", group, name, shard), 0, nil)
+}
+
+// SetCount sets the named counter in group to n, and gets how much it
+// changed by. The shards are read and corrected in one transaction, so
+// increments made meanwhile are kept.
+func SetCount(ctx context.Context, group, name string, n int64) (int64, error) {
+	var delta int64
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		delta, err = SetCountInTransaction(ctx, group, name, n)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return 0, errors.Wrap(err, "set "+group)
+	}
+	if delta != 0 {
+		if err := memcache.Delete(ctx, counterCacheKey(group, name)); err != nil && err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "memcache delete: %s", err)
+		}
+	}
+	return delta, nil
+}
+
+// SetCountInTransaction sets the named counter in group to n using ctx,
+// which must be a cross-group transaction context, and gets how much it
+// changed by. The cached total is not cleared, so Count may lag by up to
+// countCacheExpiration.
+func SetCountInTransaction(ctx context.Context, group, name string, n int64) (int64, error) {
+	keys := make([]*datastore.Key, counterShards)
+	for i := range keys {
+		keys[i] = shardKey(ctx, group, name, i)
+	}
+	shards := make([]counterShard, counterShards)
+	err := datastore.GetMulti(ctx, keys, shards)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return 0, err
+			}
+		}
+	} else if err != nil {
+		return 0, err
+	}
+	var counted int64
+	for _, s := range shards {
+		counted += s.Count
+	}
+	delta := n - counted
+	if delta == 0 {
+		return 0, nil
+	}
+	s := shards[0]
+	s.Group = group
+	s.Name = name
+	s.Count += delta
+	_, err = datastore.Put(ctx, keys[0], &s)
+	return delta, err
+}
+
+// DeleteCount deletes the named counter in group, so it no longer
+// counts towards Top.
+func DeleteCount(ctx context.Context, group, name string) error {
+	keys := make([]*datastore.Key, counterShards)
+	for i := range keys {
+		keys[i] = shardKey(ctx, group, name, i)
+	}
+	if err := datastore.DeleteMulti(ctx, keys); err != nil {
+		return errors.Wrap(err, "delete "+group)
+	}
+	if err := memcache.Delete(ctx, counterCacheKey(group, name)); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "memcache delete: %s", err)
+	}
+	return nil
+}
+
+// Count gets the total for the named counter in group.
+func Count(ctx context.Context, group, name string) (int64, error) {
+	cacheKey := counterCacheKey(group, name)
+	if item, err := memcache.Get(ctx, cacheKey); err == nil {
+		if n, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	var n int64
+	var shards []counterShard
+	q := datastore.NewQuery(counterShardKind).Filter("Group =", group).Filter("Name =", name)
+	if _, err := q.GetAll(ctx, &shards); err != nil {
+		return 0, errors.Wrap(err, "load shards")
+	}
+	for _, s := range shards {
+		n += s.Count
+	}
+	// stored as a decimal string so memcache.IncrementExisting works
+	item := &memcache.Item{
+		Key:        cacheKey,
+		Value:      []byte(strconv.FormatInt(n, 10)),
+		Expiration: countCacheExpiration,
+	}
+	if err := memcache.Set(ctx, item); err != nil {
+		log.Warningf(ctx, "memcache set: %s", err)
+	}
+	return n, nil
+}
+
+// Top gets up to limit counters in group with the highest totals.
+// Totals are built from the busiest shards so they are approximate
+// for counters that fall outside the top.
+func Top(ctx context.Context, group string, limit int) ([]CounterTotal, error) {
+	var shards []counterShard
+	q := datastore.NewQuery(counterShardKind).Filter("Group =", group).Order("-Count").Limit(limit * counterShards)
+	if _, err := q.GetAll(ctx, &shards); err != nil {
+		return nil, errors.Wrap(err, "load shards")
+	}
+	totals := make(map[string]int64)
+	for _, s := range shards {
+		totals[s.Name] += s.Count
+	}
+	top := make([]CounterTotal, 0, len(totals))
+	for name, n := range totals {
+		top = append(top, CounterTotal{Name: name, Count: n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Name < top[j].Name
+		}
+		return top[i].Count > top[j].Count
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top, nil
+}
+
+// CountRange gets the totals of every counter in group whose name
+// falls between from and to inclusive, keyed by name.
+func CountRange(ctx context.Context, group, from, to string) (map[string]int64, error) {
+	var shards []counterShard
+	q := datastore.NewQuery(counterShardKind).Filter("Group =", group).Filter("Name >=", from).Filter("Name <=", to)
+	if _, err := q.GetAll(ctx, &shards); err != nil {
+		return nil, errors.Wrap(err, "load shards")
+	}
+	totals := make(map[string]int64)
+	for _, s := range shards {
+		totals[s.Name] += s.Count
+	}
+	return totals, nil
+}
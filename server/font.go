@@ -0,0 +1,56 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+)
+
+var labelFont struct {
+	once sync.Once
+	font *opentype.Font
+	err  error
+}
+
+// fontFace gets a face of the bundled Go Regular font at size
+// points (which are pixels at 72 DPI).
+func fontFace(size float64) (font.Face, error) {
+	labelFont.once.Do(func() {
+		labelFont.font, labelFont.err = opentype.Parse(goregular.TTF)
+	})
+	if labelFont.err != nil {
+		return nil, errors.Wrap(labelFont.err, "parse font")
+	}
+	face, err := opentype.NewFace(labelFont.font, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "font face")
+	}
+	return face, nil
+}
+
+// withGlyphs drops the characters in s that the bundled font can't
+// draw, such as emoji, rather than drawing them as boxes.
+func withGlyphs(s string) string {
+	if labelFont.font == nil {
+		return s
+	}
+	var buf sfnt.Buffer
+	return strings.Map(func(r rune) rune {
+		if r == ' ' {
+			return r
+		}
+		if i, err := labelFont.font.GlyphIndex(&buf, r); err != nil || i == 0 {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+const (
+	// identifyWidth is the width images are compared at.
+	identifyWidth = 128
+	// opaque is the alpha above which an item's pixel hides those
+	// below it.
+	opaque = 250
+	// matchTolerance is how far apart each channel of two pixels may be
+	// for them to match.
+	matchTolerance = 32
+	// minItemScore is the fraction of an item's visible pixels that
+	// must match for it to be chosen.
+	minItemScore = 0.85
+	// minVisible is the fewest visible pixels an item needs to be
+	// chosen.
+	minVisible = 8
+)
+
+// identifyFormats decode the images identify accepts, by their sniffed
+// content type. They are used instead of image.Decode so uploads are
+// never handed to the SVG decoder.
+var identifyFormats = map[string]struct {
+	decodeConfig func(io.Reader) (image.Config, error)
+	decode       func(io.Reader) (image.Image, error)
+}{
+	"image/png":  {png.DecodeConfig, png.Decode},
+	"image/gif":  {gif.DecodeConfig, gif.Decode},
+	"image/jpeg": {jpeg.DecodeConfig, jpeg.Decode},
+}
+
+// Errors from Identify about the image itself.
+var (
+	ErrNotGopher  = errors.New("that doesn't look like a gopher")
+	ErrWrongShape = errors.New("image must be the same shape as the artwork")
+)
+
+// Identification is the selection that best explains an image.
+type Identification struct {
+	// Images is the selection, in layer order.
+	Images []string `json:"images"`
+	// Confidence is the fraction of pixels the selection reproduces.
+	Confidence float64 `json:"confidence"`
+	// Layers is the choice made for each category, in layer order.
+	Layers []IdentifiedLayer `json:"layers"`
+}
+
+// IdentifiedLayer is the item chosen from a category.
+type IdentifiedLayer struct {
+	Category string `json:"category"`
+	// Image is the ID of the item, or empty if none was chosen.
+	Image string `json:"image,omitempty"`
+	// Score is the fraction of the item's visible pixels that match.
+	Score float64 `json:"score"`
+}
+
+// identifyIndex holds every artwork item at identifyWidth, built once
+// per catalog version of each pack. The lock is only held to read and
+// replace the map, so requests made while an index is built may build
+// it too.
+var identifyIndex struct {
+	sync.Mutex
+	packs map[string]*packIndex
+}
+
+type packIndex struct {
+	version string
+	// canvas is the size of the artwork, and size the size it is
+	// compared at.
+	canvas     image.Rectangle
+	size       image.Rectangle
+	categories []indexCategory
+}
+
+type indexCategory struct {
+	name  string
+	items []indexItem
+}
+
+type indexItem struct {
+	id  string
+	img *image.NRGBA
+}
+
+// loadIdentifyIndex gets the samples of every item in the pack,
+// building them if the catalog has changed.
+func loadIdentifyIndex(ctx context.Context, pack string) (*packIndex, error) {
+	catalog, err := loadArtwork(ctx, pack, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "load artwork")
+	}
+	identifyIndex.Lock()
+	index := identifyIndex.packs[pack]
+	identifyIndex.Unlock()
+	if index != nil && index.version == catalog.Version {
+		return index, nil
+	}
+	var ids []string
+	for _, cat := range catalog.Categories {
+		for _, img := range cat.Images {
+			ids = append(ids, img.ID)
+		}
+	}
+	images, err := LoadImages(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	canvas, layers := splitFrames(image.Rect(0, 0, catalog.Width, catalog.Height), images)
+	if canvas.Empty() {
+		return nil, errors.New("Artwork is being updated - please try again later")
+	}
+	size := image.Rect(0, 0, identifyWidth, identifyWidth*canvas.Dy()/canvas.Dx())
+	var categories []indexCategory
+	i := 0
+	for _, cat := range catalog.Categories {
+		c := indexCategory{name: cat.Name}
+		for _, img := range cat.Images {
+			if l := layers[i]; len(l) > 0 {
+				// animated items are matched on their first frame
+				c.items = append(c.items, indexItem{id: img.ID, img: sample(l[0], size)})
+			}
+			i++
+		}
+		categories = append(categories, c)
+	}
+	index = &packIndex{
+		version:    catalog.Version,
+		canvas:     canvas,
+		size:       size,
+		categories: categories,
+	}
+	identifyIndex.Lock()
+	if identifyIndex.packs == nil {
+		identifyIndex.packs = make(map[string]*packIndex)
+	}
+	identifyIndex.packs[pack] = index
+	identifyIndex.Unlock()
+	return index, nil
+}
+
+// checkIdentifySize checks an image of the size in conf could be a
+// render of the artwork in index: the same shape as its canvas, and no
+// wider than the biggest render. It is checked before the image is
+// decoded, so nothing bigger is.
+func checkIdentifySize(conf image.Config, index *packIndex) error {
+	canvas := index.canvas
+	if conf.Width < 1 || conf.Width > maxRenderSize {
+		return ErrWrongShape
+	}
+	// renders round their height down
+	if conf.Height != conf.Width*canvas.Dy()/canvas.Dx() && conf.Width*canvas.Dy() != conf.Height*canvas.Dx() {
+		return ErrWrongShape
+	}
+	return nil
+}
+
+// sample scales img to size for comparing.
+func sample(img image.Image, size image.Rectangle) *image.NRGBA {
+	dst := image.NewNRGBA(size)
+	xdraw.ApproxBiLinear.Scale(dst, size, img, img.Bounds(), xdraw.Src, nil)
+	return dst
+}
+
+// Identify works out which artwork item from each category of the pack
+// best explains img, which should be a render of the same shape as the
+// artwork. Layers are peeled off greedily from the top: each category
+// picks the item whose visible pixels best match, and the pixels it
+// covers are then ignored by the categories below.
+func Identify(ctx context.Context, pack string, img image.Image) (Identification, error) {
+	index, err := loadIdentifyIndex(ctx, pack)
+	if err != nil {
+		return Identification{}, err
+	}
+	b := img.Bounds()
+	if err := checkIdentifySize(image.Config{Width: b.Dx(), Height: b.Dy()}, index); err != nil {
+		return Identification{}, err
+	}
+	return identify(img, index)
+}
+
+// identify does the work of Identify on an image that has passed
+// checkIdentifySize.
+func identify(img image.Image, index *packIndex) (Identification, error) {
+	var id Identification
+	size, categories := index.size, index.categories
+	target := sample(img, size)
+	covered := make([]bool, size.Dx()*size.Dy())
+	layers := make([]IdentifiedLayer, len(categories))
+	var chosen []*image.NRGBA
+	for c := len(categories) - 1; c >= 0; c-- {
+		cat := categories[c]
+		layers[c].Category = cat.name
+		var best *indexItem
+		var bestScore float64
+		var bestMatched int
+		for i := range cat.items {
+			item := &cat.items[i]
+			score, matched := scoreItem(item.img, target, covered)
+			if score > bestScore+0.01 || (score > bestScore-0.01 && matched > bestMatched) {
+				best, bestScore, bestMatched = item, score, matched
+			}
+		}
+		if best == nil || bestScore < minItemScore {
+			continue
+		}
+		layers[c].Image = best.id
+		layers[c].Score = bestScore
+		chosen = append(chosen, best.img)
+		for i := range covered {
+			if best.img.Pix[i*4+3] >= opaque {
+				covered[i] = true
+			}
+		}
+	}
+	for _, l := range layers {
+		if l.Image != "" {
+			id.Images = append(id.Images, l.Image)
+		}
+	}
+	if len(id.Images) == 0 {
+		return id, ErrNotGopher
+	}
+	id.Layers = layers
+	// chosen is top first, so stack it in reverse
+	output := image.NewNRGBA(size)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		xdraw.Draw(output, size, chosen[i], image.Point{}, xdraw.Over)
+	}
+	id.Confidence = similarity(output, target)
+	return id, nil
+}
+
+// scoreItem gets the fraction of the item's opaque pixels not covered
+// by higher layers that match target, and how many matched.
+func scoreItem(item, target *image.NRGBA, covered []bool) (float64, int) {
+	var visible, matched int
+	for i := range covered {
+		p := i * 4
+		if covered[i] || item.Pix[p+3] < opaque {
+			continue
+		}
+		visible++
+		if pixelsMatch(item.Pix[p:p+4], target.Pix[p:p+4]) {
+			matched++
+		}
+	}
+	if visible < minVisible {
+		return 0, 0
+	}
+	return float64(matched) / float64(visible), matched
+}
+
+// similarity gets the fraction of pixels that match, ignoring those
+// that are transparent in both images.
+func similarity(a, b *image.NRGBA) float64 {
+	var n, matched int
+	for p := 0; p < len(a.Pix); p += 4 {
+		if a.Pix[p+3] == 0 && b.Pix[p+3] == 0 {
+			continue
+		}
+		n++
+		if pixelsMatch(a.Pix[p:p+4], b.Pix[p:p+4]) {
+			matched++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(matched) / float64(n)
+}
+
+func pixelsMatch(a, b []uint8) bool {
+	for i := 0; i < 4; i++ {
+		d := int(a[i]) - int(b[i])
+		if d < -matchTolerance || d > matchTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// identifyHandler identifies the gopher image in the request body,
+// using the pack in the pack parameter. Renders that still carry their
+// provenance are read directly.
+func (s server) identifyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Method != http.MethodPost {
+		s.responderr(ctx, w, r, http.StatusMethodNotAllowed, errors.New("POST an image"))
+		return
+	}
+	pack := r.URL.Query().Get("pack")
+	if err := CheckPack(pack); err != nil {
+		s.responderr(ctx, w, r, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := s.checkPack(ctx, r, pack); err == ErrPrivatePack {
+		s.responderr(ctx, w, r, http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		s.responderr(ctx, w, r, http.StatusInternalServerError, err)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDecodeSize))
+	if err != nil {
+		s.responderr(ctx, w, r, http.StatusBadRequest, err)
+		return
+	}
+	var id Identification
+	if p, err := DecodeProvenance(bytes.NewReader(data)); err == nil {
+		id.Images = p.Images
+		id.Confidence = 1
+		pack = p.Pack
+	} else {
+		format, ok := identifyFormats[http.DetectContentType(data)]
+		if !ok {
+			s.responderr(ctx, w, r, http.StatusUnprocessableEntity, errors.New("image must be a PNG, GIF or JPEG"))
+			return
+		}
+		conf, err := format.decodeConfig(bytes.NewReader(data))
+		if err != nil {
+			s.responderr(ctx, w, r, http.StatusUnprocessableEntity, errors.Wrap(err, "decode image"))
+			return
+		}
+		index, err := loadIdentifyIndex(ctx, pack)
+		if err != nil {
+			s.responderr(ctx, w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if err := checkIdentifySize(conf, index); err != nil {
+			s.responderr(ctx, w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		img, err := format.decode(bytes.NewReader(data))
+		if err != nil {
+			s.responderr(ctx, w, r, http.StatusUnprocessableEntity, errors.Wrap(err, "decode image"))
+			return
+		}
+		id, err = identify(img, index)
+		if err == ErrNotGopher {
+			s.responderr(ctx, w, r, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if err != nil {
+			s.responderr(ctx, w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	edit := url.Values{"images": []string{strings.Join(id.Images, "|")}}
+	if pack != "" {
+		edit.Set("pack", pack)
+	}
+	res := struct {
+		Identification
+		EditURL string `json:"edit_url"`
+	}{
+		Identification: id,
+		EditURL:        "/?" + edit.Encode(),
+	}
+	s.respond(ctx, w, r, http.StatusOK, res)
+}
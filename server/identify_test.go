@@ -0,0 +1,131 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+// testIndex makes an index of a small pack of flat-coloured artwork, as
+// loadIdentifyIndex would, and gets the items by ID.
+func testIndex() (*packIndex, map[string]image.Image) {
+	canvas := image.Rect(0, 0, 64, 48)
+	fill := func(c color.Color, rects ...image.Rectangle) image.Image {
+		img := image.NewNRGBA(canvas)
+		for _, r := range rects {
+			draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+		}
+		return img
+	}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	body := image.Rect(8, 8, 56, 44)
+	items := map[string]image.Image{
+		"artwork/010-Body/blue.png":  fill(color.NRGBA{B: 255, A: 255}, body),
+		"artwork/010-Body/green.png": fill(color.NRGBA{G: 200, A: 255}, body),
+		"artwork/020-Eyes/round.png": fill(white, image.Rect(16, 14, 24, 22), image.Rect(40, 14, 48, 22)),
+		"artwork/020-Eyes/wide.png":  fill(white, image.Rect(12, 14, 28, 20), image.Rect(36, 14, 52, 20)),
+		"artwork/030-Hat/cap.png":    fill(color.NRGBA{R: 255, A: 255}, image.Rect(8, 0, 56, 8)),
+		"artwork/030-Hat/top.png":    fill(color.NRGBA{A: 255}, image.Rect(20, 0, 44, 8)),
+	}
+	index := &packIndex{
+		version: "test",
+		canvas:  canvas,
+		size:    image.Rect(0, 0, identifyWidth, identifyWidth*canvas.Dy()/canvas.Dx()),
+	}
+	for _, cat := range []struct {
+		name string
+		ids  []string
+	}{
+		{"Body", []string{"artwork/010-Body/blue.png", "artwork/010-Body/green.png"}},
+		{"Eyes", []string{"artwork/020-Eyes/round.png", "artwork/020-Eyes/wide.png"}},
+		{"Hat", []string{"artwork/030-Hat/cap.png", "artwork/030-Hat/top.png"}},
+	} {
+		c := indexCategory{name: cat.name}
+		for _, id := range cat.ids {
+			c.items = append(c.items, indexItem{id: id, img: sample(items[id], index.size)})
+		}
+		index.categories = append(index.categories, c)
+	}
+	return index, items
+}
+
+func TestIdentify(t *testing.T) {
+	index, items := testIndex()
+	tests := []struct {
+		name   string
+		images []string
+		width  int
+	}{
+		{"body and eyes", []string{"artwork/010-Body/green.png", "artwork/020-Eyes/wide.png"}, 64},
+		{"everything", []string{"artwork/010-Body/blue.png", "artwork/020-Eyes/round.png", "artwork/030-Hat/top.png"}, 64},
+		{"scaled up", []string{"artwork/010-Body/blue.png", "artwork/020-Eyes/wide.png", "artwork/030-Hat/cap.png"}, 300},
+		{"scaled down", []string{"artwork/010-Body/green.png", "artwork/030-Hat/cap.png"}, 48},
+	}
+	for _, test := range tests {
+		layers := make([]layer, len(test.images))
+		for i, id := range test.images {
+			layers[i] = layer{items[id]}
+		}
+		// as the render API draws it
+		canvas, layers := resizeLayers(index.canvas, layers, test.width)
+		render := composeFrame(canvas, layers, 0)
+		conf := image.Config{Width: render.Bounds().Dx(), Height: render.Bounds().Dy()}
+		if err := checkIdentifySize(conf, index); err != nil {
+			t.Errorf("%s: %dx%d: %v", test.name, conf.Width, conf.Height, err)
+			continue
+		}
+		id, err := identify(render, index)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(id.Images, test.images) {
+			t.Errorf("%s: got %v, want %v", test.name, id.Images, test.images)
+		}
+		if id.Confidence < minItemScore {
+			t.Errorf("%s: got confidence %.2f, want at least %.2f", test.name, id.Confidence, minItemScore)
+		}
+		if len(id.Layers) != len(index.categories) {
+			t.Errorf("%s: got %d layers, want one for each category", test.name, len(id.Layers))
+		}
+	}
+}
+
+func TestIdentifyNotGopher(t *testing.T) {
+	index, _ := testIndex()
+	blank := image.NewRGBA(index.canvas)
+	if _, err := identify(blank, index); err != ErrNotGopher {
+		t.Errorf("blank: got %v, want %v", err, ErrNotGopher)
+	}
+	orange := image.NewRGBA(index.canvas)
+	draw.Draw(orange, orange.Bounds(), image.NewUniform(color.RGBA{R: 255, G: 128, A: 255}), image.Point{}, draw.Src)
+	if _, err := identify(orange, index); err != ErrNotGopher {
+		t.Errorf("orange: got %v, want %v", err, ErrNotGopher)
+	}
+}
+
+func TestCheckIdentifySize(t *testing.T) {
+	index, _ := testIndex()
+	tests := []struct {
+		width, height int
+		ok            bool
+	}{
+		{64, 48, true},
+		{300, 225, true},
+		// renders round their height down
+		{301, 225, true},
+		{300, 226, false},
+		{48, 64, false},
+		{0, 0, false},
+		{maxRenderSize, maxRenderSize * 3 / 4, true},
+		{maxRenderSize + 4, (maxRenderSize + 4) * 3 / 4, false},
+	}
+	for _, test := range tests {
+		err := checkIdentifySize(image.Config{Width: test.width, Height: test.height}, index)
+		if (err == nil) != test.ok {
+			t.Errorf("%dx%d: got %v, want ok %v", test.width, test.height, err, test.ok)
+		}
+	}
+}
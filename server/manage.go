@@ -0,0 +1,487 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	artworkPrefix = "artwork/"
+	// maxArtworkSize is the biggest artwork file that may be uploaded.
+	maxArtworkSize = 5 << 20
+	// maxPosition is the highest order prefix, since they have three
+	// digits.
+	maxPosition = 999
+)
+
+// Errors from managing artwork.
+var (
+	ErrArtworkNotFound = errors.New("no such artwork")
+	ErrArtworkExists   = errors.New("artwork with that name already exists")
+)
+
+var (
+	// categories become HTML IDs in the app so they are kept simple
+	categoryNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,40}$`)
+	itemNamePattern     = regexp.MustCompile(`^[A-Za-z0-9_ ]{1,60}$`)
+	positionPattern     = regexp.MustCompile(`^[0-9]+-`)
+)
+
+// ArtworkUpload is a new artwork item, or a high resolution variant of
+// one.
+type ArtworkUpload struct {
+	// Category is the name of the category, such as Eyes. It is
+	// created at Position if it doesn't exist.
+	Category string
+	Position int
+	// Name is the name of the item. Spaces become underscores.
+	Name string
+	// Variant is 2 or 4 for an @2x or @4x version, otherwise 0.
+	Variant int
+	Artist  string
+	License string
+	Data    []byte
+}
+
+// CheckArtworkName checks the name of an item.
+func CheckArtworkName(name string) error {
+	if !itemNamePattern.MatchString(name) {
+		return errors.New("names must be letters, numbers, spaces and underscores")
+	}
+	return nil
+}
+
+// CheckCategoryName checks the name of a category.
+func CheckCategoryName(name string) error {
+	if !categoryNamePattern.MatchString(name) {
+		return errors.New("category names must be letters, numbers and underscores")
+	}
+	return nil
+}
+
+// CheckState checks a lifecycle state.
+func CheckState(state string) error {
+	switch state {
+	case StateActive, StateHidden, StateRetired:
+		return nil
+	}
+	return errors.Errorf("state must be %s, %s or %s", StateActive, StateHidden, StateRetired)
+}
+
+// CheckPosition checks an order prefix.
+func CheckPosition(position int) error {
+	if position < 0 || position > maxPosition {
+		return errors.Errorf("position must be between 0 and %d", maxPosition)
+	}
+	return nil
+}
+
+// CheckArtwork applies the catalog rules to an upload: it must be a
+// PNG or an SVG that passes CheckSVG, and the same size as the rest of
+// the artwork (or a whole number of frames wide for a sprite strip, or
+// 2 or 4 times bigger for a variant). It gets the content type.
+func CheckArtwork(ctx context.Context, u ArtworkUpload) (string, error) {
+	if err := CheckCategoryName(u.Category); err != nil {
+		return "", err
+	}
+	if err := CheckArtworkName(u.Name); err != nil {
+		return "", err
+	}
+	if err := CheckPosition(u.Position); err != nil {
+		return "", err
+	}
+	if len(u.Data) > maxArtworkSize {
+		return "", errors.Errorf("artwork must be at most %d MB", maxArtworkSize>>20)
+	}
+	conf, format, err := image.DecodeConfig(bytes.NewReader(u.Data))
+	if err != nil {
+		return "", errors.Wrap(err, "artwork must be a PNG or SVG")
+	}
+	contentType := map[string]string{"png": "image/png", "svg": svgContentType}[format]
+	if contentType == "" {
+		return "", errors.New("artwork must be a PNG or SVG")
+	}
+	if u.Variant != 0 && (format != "png" || (u.Variant != 2 && u.Variant != 4)) {
+		return "", errors.New("only PNGs have @2x or @4x variants")
+	}
+	if format == "svg" {
+		if err := CheckSVG(u.Data); err != nil {
+			return "", err
+		}
+	}
+	canvas, err := artworkCanvas(ctx)
+	if err != nil {
+		return "", err
+	}
+	if canvas.Empty() {
+		// the first item sets the size
+		return contentType, nil
+	}
+	factor := 1
+	if u.Variant != 0 {
+		factor = u.Variant
+	}
+	if err := checkSize(conf, format, canvas, factor); err != nil {
+		return "", err
+	}
+	return contentType, nil
+}
+
+// checkSize checks an item of the format (png or svg) fits the canvas:
+// SVGs must be the same shape, and PNGs factor times its size or a strip
+// of frames that size.
+func checkSize(conf image.Config, format string, canvas image.Rectangle, factor int) error {
+	if format == "svg" {
+		if conf.Width*canvas.Dy() != conf.Height*canvas.Dx() {
+			return errors.Errorf("SVGs must be the same shape as the artwork (%dx%d)", canvas.Dx(), canvas.Dy())
+		}
+		return nil
+	}
+	w, h := canvas.Dx()*factor, canvas.Dy()*factor
+	if conf.Height != h || conf.Width%w != 0 {
+		return errors.Errorf("artwork must be %dx%d, or a strip of %dx%d frames", w, h, w, h)
+	}
+	return nil
+}
+
+// artworkCanvas gets the size of the artwork from the catalog. It is
+// empty if there is no artwork yet.
+func artworkCanvas(ctx context.Context) (image.Rectangle, error) {
+	return catalogCanvas(ctx, "")
+}
+
+// UploadArtwork writes an artwork item, and refreshes the catalog. The
+// upload must have passed CheckArtwork, which gives its content type.
+// It gets the ID of the item, or ErrArtworkExists if there is already
+// one with the same name.
+func UploadArtwork(ctx context.Context, u ArtworkUpload, contentType string) (string, error) {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return "", err
+	}
+	objects, err := listArtwork(ctx, bucket, artworkPrefix)
+	if err != nil {
+		return "", errors.Wrap(err, "list artwork")
+	}
+	dir, ok := findCategory(objects, u.Category)
+	if !ok {
+		dir = categoryDir(u.Position, u.Category)
+	}
+	ext := map[string]string{"image/png": ".png", svgContentType: ".svg"}[contentType]
+	id := dir + "/" + strings.Replace(u.Name, " ", "_", -1) + ext
+	if u.Variant != 0 {
+		id = variantName(id, u.Variant)
+	}
+	// items are never replaced, as saved gophers may use them
+	objW := bucket.Object(id).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	objW.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	objW.ContentType = contentType
+	objW.Metadata = map[string]string{}
+	if u.Artist != "" {
+		objW.Metadata["artist"] = u.Artist
+	}
+	if u.License != "" {
+		objW.Metadata["license"] = u.License
+	}
+	if _, err := objW.Write(u.Data); err != nil {
+		objW.Close()
+		return "", errors.Wrap(err, "write artwork")
+	}
+	if err := objW.Close(); err != nil {
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+			return "", ErrArtworkExists
+		}
+		return "", errors.Wrap(err, "write artwork")
+	}
+	return id, RefreshArtwork(ctx)
+}
+
+// RenameArtwork renames an item, keeping its position and variants.
+// Selections using the old ID will no longer find it, so check nothing
+// saved uses it first. It gets the new ID.
+func RenameArtwork(ctx context.Context, id, name string) (string, error) {
+	if err := CheckArtworkName(name); err != nil {
+		return "", err
+	}
+	base := path.Base(id)
+	prefix := positionPattern.FindString(base)
+	newID := path.Dir(id) + "/" + prefix + strings.Replace(name, " ", "_", -1) + path.Ext(id)
+	return newID, moveItem(ctx, id, newID)
+}
+
+// MoveArtwork sets the position of an item within its category. Like
+// RenameArtwork it changes the ID, which it gets.
+func MoveArtwork(ctx context.Context, id string, position int) (string, error) {
+	if err := CheckPosition(position); err != nil {
+		return "", err
+	}
+	base := positionPattern.ReplaceAllString(path.Base(id), "")
+	newID := fmt.Sprintf("%s/%03d-%s", path.Dir(id), position, base)
+	return newID, moveItem(ctx, id, newID)
+}
+
+// SetArtworkState sets the lifecycle state of an item.
+func SetArtworkState(ctx context.Context, id, state string) error {
+	if err := CheckState(state); err != nil {
+		return err
+	}
+	return updateArtwork(ctx, func(o *storage.ObjectAttrs) bool {
+		return o.Name == id
+	}, "state", stateMetadata(state))
+}
+
+// DeleteArtwork deletes an item and its variants.
+func DeleteArtwork(ctx context.Context, id string) error {
+	return deleteArtwork(ctx, func(o *storage.ObjectAttrs) bool {
+		return o.Name == id || isVariantOf(o.Name, id)
+	})
+}
+
+// RenameCategory renames a category, keeping its position.
+// Selections using its items will no longer find them.
+func RenameCategory(ctx context.Context, category, name string) error {
+	if err := CheckCategoryName(name); err != nil {
+		return err
+	}
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return err
+	}
+	objects, err := listArtwork(ctx, bucket, artworkPrefix)
+	if err != nil {
+		return errors.Wrap(err, "list artwork")
+	}
+	if _, ok := findCategory(objects, name); ok && name != category {
+		return ErrArtworkExists
+	}
+	return moveCategory(ctx, category, func(position int) string {
+		return categoryDir(position, name)
+	})
+}
+
+// MoveCategory sets the position of a category.
+// Selections using its items will no longer find them.
+func MoveCategory(ctx context.Context, category string, position int) error {
+	if err := CheckPosition(position); err != nil {
+		return err
+	}
+	return moveCategory(ctx, category, func(int) string {
+		return categoryDir(position, category)
+	})
+}
+
+// SetCategoryState sets the lifecycle state of every item in a
+// category.
+func SetCategoryState(ctx context.Context, category, state string) error {
+	if err := CheckState(state); err != nil {
+		return err
+	}
+	return updateArtwork(ctx, func(o *storage.ObjectAttrs) bool {
+		return categoryName(o.Name) == category
+	}, "state", stateMetadata(state))
+}
+
+// stateMetadata gets the state metadata value, which is left off for
+// active items.
+func stateMetadata(state string) string {
+	if state == StateActive {
+		return ""
+	}
+	return state
+}
+
+// DeleteCategory deletes a category and all its items.
+func DeleteCategory(ctx context.Context, category string) error {
+	return deleteArtwork(ctx, func(o *storage.ObjectAttrs) bool {
+		return categoryName(o.Name) == category
+	})
+}
+
+// RefreshArtwork rebuilds the cached catalog straight away.
+func RefreshArtwork(ctx context.Context) error {
+	return RefreshPack(ctx, "")
+}
+
+// RefreshPack rebuilds the cached catalog of the pack straight away.
+func RefreshPack(ctx context.Context, pack string) error {
+	if _, err := loadArtwork(ctx, pack, false); err != nil {
+		return errors.Wrap(err, "refresh artwork")
+	}
+	return nil
+}
+
+func categoryDir(position int, name string) string {
+	return fmt.Sprintf("%s%03d-%s", artworkPrefix, position, name)
+}
+
+// categoryName gets the name of the category holding the object.
+func categoryName(object string) string {
+	segs := strings.Split(path.Base(path.Dir(object)), "-")
+	if len(segs) != 2 {
+		return ""
+	}
+	return segs[1]
+}
+
+// categoryPosition gets the position of the category holding the
+// object.
+func categoryPosition(object string) int {
+	n, _ := strconv.Atoi(strings.Split(path.Base(path.Dir(object)), "-")[0])
+	return n
+}
+
+func findCategory(objects []*storage.ObjectAttrs, name string) (string, bool) {
+	for _, o := range objects {
+		if categoryName(o.Name) == name {
+			return path.Dir(o.Name), true
+		}
+	}
+	return "", false
+}
+
+func isVariantOf(name, id string) bool {
+	for _, factor := range variantScales {
+		if name == variantName(id, factor) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveItem moves an item and its variants to newID.
+func moveItem(ctx context.Context, id, newID string) error {
+	if newID == id {
+		return nil
+	}
+	moves := map[string]string{id: newID}
+	for _, factor := range variantScales {
+		moves[variantName(id, factor)] = variantName(newID, factor)
+	}
+	return moveArtwork(ctx, func(o *storage.ObjectAttrs) (string, bool) {
+		to, ok := moves[o.Name]
+		return to, ok
+	})
+}
+
+// moveCategory moves every object in a category to the directory dir
+// gets for its position.
+func moveCategory(ctx context.Context, category string, dir func(position int) string) error {
+	return moveArtwork(ctx, func(o *storage.ObjectAttrs) (string, bool) {
+		if categoryName(o.Name) != category {
+			return "", false
+		}
+		return dir(categoryPosition(o.Name)) + "/" + path.Base(o.Name), true
+	})
+}
+
+// moveArtwork copies each object that to names somewhere else, then
+// deletes the original, and refreshes the catalog.
+func moveArtwork(ctx context.Context, to func(o *storage.ObjectAttrs) (string, bool)) error {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return err
+	}
+	objects, err := listArtwork(ctx, bucket, artworkPrefix)
+	if err != nil {
+		return errors.Wrap(err, "list artwork")
+	}
+	moved := 0
+	for _, o := range objects {
+		name, ok := to(o)
+		if !ok || name == o.Name {
+			continue
+		}
+		if _, err := bucket.Object(name).Attrs(ctx); err != storage.ErrObjectNotExist {
+			if err == nil {
+				err = ErrArtworkExists
+			}
+			return err
+		}
+		copier := bucket.Object(name).CopierFrom(bucket.Object(o.Name))
+		copier.ContentType = o.ContentType
+		copier.Metadata = o.Metadata
+		copier.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+		if _, err := copier.Run(ctx); err != nil {
+			return errors.Wrapf(err, "copy %s", o.Name)
+		}
+		if err := bucket.Object(o.Name).Delete(ctx); err != nil {
+			return errors.Wrapf(err, "delete %s", o.Name)
+		}
+		moved++
+	}
+	if moved == 0 {
+		return ErrArtworkNotFound
+	}
+	return RefreshArtwork(ctx)
+}
+
+// updateArtwork sets a metadata key of the matching objects, and
+// refreshes the catalog. An empty value deletes the key.
+func updateArtwork(ctx context.Context, match func(o *storage.ObjectAttrs) bool, key, value string) error {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return err
+	}
+	objects, err := listArtwork(ctx, bucket, artworkPrefix)
+	if err != nil {
+		return errors.Wrap(err, "list artwork")
+	}
+	updated := 0
+	for _, o := range objects {
+		if !match(o) {
+			continue
+		}
+		metadata := make(map[string]string)
+		for k, v := range o.Metadata {
+			metadata[k] = v
+		}
+		metadata[key] = value
+		_, err := bucket.Object(o.Name).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+		if err != nil {
+			return errors.Wrapf(err, "update %s", o.Name)
+		}
+		updated++
+	}
+	if updated == 0 {
+		return ErrArtworkNotFound
+	}
+	return RefreshArtwork(ctx)
+}
+
+// deleteArtwork deletes the matching objects, and refreshes the
+// catalog.
+func deleteArtwork(ctx context.Context, match func(o *storage.ObjectAttrs) bool) error {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return err
+	}
+	objects, err := listArtwork(ctx, bucket, artworkPrefix)
+	if err != nil {
+		return errors.Wrap(err, "list artwork")
+	}
+	deleted := 0
+	for _, o := range objects {
+		if !match(o) {
+			continue
+		}
+		if err := bucket.Object(o.Name).Delete(ctx); err != nil {
+			return errors.Wrapf(err, "delete %s", o.Name)
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return ErrArtworkNotFound
+	}
+	return RefreshArtwork(ctx)
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"image/color"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RenderOptions change how a gopher is rendered.
+// The zero value renders the artwork as it is.
+type RenderOptions struct {
+	// Text is drawn onto the gopher, if set.
+	Text *TextOptions
+	// Overlays are drawn over the gopher, in order.
+	Overlays []Overlay
+	// FrameDelay is how long each frame of an animation is shown, in
+	// milliseconds. Zero means the default.
+	FrameDelay int
+	// Size is the width of the render in pixels. Zero means the
+	// artwork's own size.
+	Size int
+	// Scale multiplies the artwork's own size, using its high
+	// resolution variants where there are any. Zero means 1.
+	Scale float64
+	// DPI is written into PNG renders so they print at the right size.
+	// Zero leaves it out.
+	DPI int
+}
+
+// ParseRenderOptions reads RenderOptions from render API parameters:
+//
+//	text               - text to draw, such as a name
+//	text_pos           - top, bottom or below (default below)
+//	text_size          - font size in pixels (default 48)
+//	text_color         - hex colour (default 000000)
+//	text_outline       - outline width in pixels (default 0)
+//	text_outline_color - hex colour (default ffffff)
+//	say                - text for a speech bubble
+//	think              - text for a thought bubble
+//	bubble_at          - x,y the bubble points to (default 0.65,0.3)
+//	sticker            - a sticker name (may be repeated)
+//	sticker_at         - x,y of the centre of each sticker (default 0.8,0.8)
+//	sticker_scale      - width of each sticker (default 0.3)
+//	delay              - milliseconds per animation frame (default 100)
+//	size               - width in pixels (default the artwork's width)
+//	scale              - multiple of the artwork's size, instead of size
+//	dpi                - dots per inch for printing PNG renders
+//
+// Overlay positions and sizes are fractions of the gopher's bounds.
+func ParseRenderOptions(q url.Values) (RenderOptions, error) {
+	var opts RenderOptions
+	if text := q.Get("text"); text != "" {
+		t := &TextOptions{
+			Position:     TextBelow,
+			Size:         48,
+			Color:        color.Black,
+			OutlineColor: color.White,
+		}
+		var err error
+		if t.Text, err = cleanRenderText(text, maxTextLen); err != nil {
+			return opts, err
+		}
+		switch pos := q.Get("text_pos"); pos {
+		case "":
+		case TextTop, TextBottom, TextBelow:
+			t.Position = pos
+		default:
+			return opts, errors.Errorf("text_pos must be %s, %s or %s", TextTop, TextBottom, TextBelow)
+		}
+		if s := q.Get("text_size"); s != "" {
+			size, err := strconv.ParseFloat(s, 64)
+			if err != nil || size < minTextSize || size > maxTextSize {
+				return opts, errors.Errorf("text_size must be between %d and %d", minTextSize, maxTextSize)
+			}
+			t.Size = size
+		}
+		if s := q.Get("text_color"); s != "" {
+			if t.Color, err = parseColor(s); err != nil {
+				return opts, errors.Wrap(err, "text_color")
+			}
+		}
+		if s := q.Get("text_outline"); s != "" {
+			outline, err := strconv.Atoi(s)
+			if err != nil || outline < 0 || outline > maxTextOutline {
+				return opts, errors.Errorf("text_outline must be between 0 and %d", maxTextOutline)
+			}
+			t.Outline = outline
+		}
+		if s := q.Get("text_outline_color"); s != "" {
+			if t.OutlineColor, err = parseColor(s); err != nil {
+				return opts, errors.Wrap(err, "text_outline_color")
+			}
+		}
+		opts.Text = t
+	}
+	if q.Get("say") != "" && q.Get("think") != "" {
+		return opts, errors.New("say or think, not both")
+	}
+	for _, kind := range []string{OverlaySpeech, OverlayThought} {
+		param := map[string]string{OverlaySpeech: "say", OverlayThought: "think"}[kind]
+		text := q.Get(param)
+		if text == "" {
+			continue
+		}
+		o := Overlay{Kind: kind, X: 0.65, Y: 0.3}
+		var err error
+		if o.Text, err = cleanRenderText(text, maxBubbleTextLen); err != nil {
+			return opts, errors.Wrap(err, param)
+		}
+		if at := q.Get("bubble_at"); at != "" {
+			if o.X, o.Y, err = parsePoint(at); err != nil {
+				return opts, errors.Wrap(err, "bubble_at")
+			}
+		}
+		opts.Overlays = append(opts.Overlays, o)
+	}
+	stickers := q["sticker"]
+	if len(stickers) > maxStickers {
+		return opts, errors.Errorf("at most %d stickers", maxStickers)
+	}
+	for i, name := range stickers {
+		if !stickerPattern.MatchString(name) {
+			return opts, errors.Errorf("bad sticker name %q", name)
+		}
+		o := Overlay{Kind: OverlaySticker, Sticker: name, X: 0.8, Y: 0.8, Scale: 0.3}
+		if i < len(q["sticker_at"]) {
+			var err error
+			if o.X, o.Y, err = parsePoint(q["sticker_at"][i]); err != nil {
+				return opts, errors.Wrap(err, "sticker_at")
+			}
+		}
+		if i < len(q["sticker_scale"]) {
+			scale, err := strconv.ParseFloat(q["sticker_scale"][i], 64)
+			if err != nil || scale <= 0 || scale > 2 {
+				return opts, errors.New("sticker_scale must be more than 0 and at most 2")
+			}
+			o.Scale = scale
+		}
+		opts.Overlays = append(opts.Overlays, o)
+	}
+	if s := q.Get("delay"); s != "" {
+		delay, err := strconv.Atoi(s)
+		if err != nil || delay < 20 || delay > 5000 {
+			return opts, errors.New("delay must be between 20 and 5000")
+		}
+		opts.FrameDelay = delay
+	}
+	if s := q.Get("size"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size < minRenderSize || size > maxRenderSize {
+			return opts, errors.Errorf("size must be between %d and %d", minRenderSize, maxRenderSize)
+		}
+		opts.Size = size
+	}
+	if s := q.Get("scale"); s != "" {
+		if opts.Size != 0 {
+			return opts, errors.New("size or scale, not both")
+		}
+		scale, err := strconv.ParseFloat(s, 64)
+		if err != nil || scale < 1 || scale > maxRenderScale {
+			return opts, errors.Errorf("scale must be between 1 and %d", maxRenderScale)
+		}
+		if scale != 1 {
+			opts.Scale = scale
+		}
+	}
+	if s := q.Get("dpi"); s != "" {
+		dpi, err := strconv.Atoi(s)
+		if err != nil || dpi < minDPI || dpi > maxDPI {
+			return opts, errors.Errorf("dpi must be between %d and %d", minDPI, maxDPI)
+		}
+		opts.DPI = dpi
+	}
+	return opts, nil
+}
+
+// parsePoint parses x,y where each is between -1 and 2.
+func parsePoint(s string) (float64, float64, error) {
+	segs := strings.Split(s, ",")
+	if len(segs) != 2 {
+		return 0, 0, errors.Errorf("bad point %q", s)
+	}
+	x, errX := strconv.ParseFloat(segs[0], 64)
+	y, errY := strconv.ParseFloat(segs[1], 64)
+	if errX != nil || errY != nil || x < -1 || x > 2 || y < -1 || y > 2 {
+		return 0, 0, errors.Errorf("bad point %q", s)
+	}
+	return x, y, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Encode gets the canonical parameters for the options, which are
+// empty for the zero value.
+func (o RenderOptions) Encode() url.Values {
+	q := url.Values{}
+	if t := o.Text; t != nil {
+		q.Set("text", t.Text)
+		q.Set("text_pos", t.Position)
+		q.Set("text_size", formatFloat(t.Size))
+		q.Set("text_color", hexColor(t.Color))
+		q.Set("text_outline", strconv.Itoa(t.Outline))
+		q.Set("text_outline_color", hexColor(t.OutlineColor))
+	}
+	for _, o := range o.Overlays {
+		at := formatFloat(o.X) + "," + formatFloat(o.Y)
+		switch o.Kind {
+		case OverlaySpeech:
+			q.Set("say", o.Text)
+			q.Set("bubble_at", at)
+		case OverlayThought:
+			q.Set("think", o.Text)
+			q.Set("bubble_at", at)
+		case OverlaySticker:
+			q.Add("sticker", o.Sticker)
+			q.Add("sticker_at", at)
+			q.Add("sticker_scale", formatFloat(o.Scale))
+		}
+	}
+	if o.FrameDelay != 0 {
+		q.Set("delay", strconv.Itoa(o.FrameDelay))
+	}
+	if o.Size != 0 {
+		q.Set("size", strconv.Itoa(o.Size))
+	}
+	if o.Scale != 0 {
+		q.Set("scale", formatFloat(o.Scale))
+	}
+	if o.DPI != 0 {
+		q.Set("dpi", strconv.Itoa(o.DPI))
+	}
+	return q
+}
+
+func hexColor(c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return fmt.Sprintf("%02x%02x%02x%02x", n.R, n.G, n.B, n.A)
+}
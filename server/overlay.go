@@ -0,0 +1,307 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/net/context"
+)
+
+// Overlay kinds.
+const (
+	// OverlaySpeech is a speech bubble.
+	OverlaySpeech = "speech"
+	// OverlayThought is a thought bubble.
+	OverlayThought = "thought"
+	// OverlaySticker is a PNG from the stickers/ prefix.
+	OverlaySticker = "sticker"
+)
+
+// Limits on overlays.
+const (
+	maxBubbleTextLen = 80
+	maxBubbleLines   = 4
+	maxStickers      = 5
+)
+
+var stickerPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Overlay is a layer drawn over the gopher.
+// Positions are fractions of the gopher's bounds (the box around its
+// visible pixels), so 0,0 is its top left and 1,1 its bottom right.
+type Overlay struct {
+	Kind string
+	// Text is what a bubble says.
+	Text string
+	// Sticker is the name of the sticker, without the stickers/
+	// prefix or .png extension.
+	Sticker string
+	// X and Y are the centre of a sticker, or the point a bubble's
+	// tail points to.
+	X, Y float64
+	// Scale is the width of a sticker as a fraction of the gopher's
+	// width.
+	Scale float64
+}
+
+// StickerObject gets the name of the object holding the sticker.
+func StickerObject(name string) string {
+	return "stickers/" + name + ".png"
+}
+
+// visibleBounds gets the smallest rectangle holding every pixel of img
+// that isn't fully transparent.
+func visibleBounds(img *image.RGBA) image.Rectangle {
+	b := img.Bounds()
+	var vis image.Rectangle
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if img.RGBAAt(x, y).A == 0 {
+				continue
+			}
+			vis = vis.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	if vis.Empty() {
+		return b
+	}
+	return vis
+}
+
+// loadStickers loads the image for each sticker overlay, in order.
+func loadStickers(ctx context.Context, overlays []Overlay) ([]image.Image, error) {
+	var names []string
+	for _, o := range overlays {
+		if o.Kind == OverlaySticker {
+			names = append(names, StickerObject(o.Sticker))
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	stickers, err := LoadImages(ctx, names...)
+	if err != nil {
+		return nil, errors.Wrap(err, "load stickers")
+	}
+	return stickers, nil
+}
+
+// drawOverlays draws the overlays onto img in order, using the
+// stickers from loadStickers.
+func drawOverlays(img *image.RGBA, overlays []Overlay, stickers []image.Image) error {
+	if len(overlays) == 0 {
+		return nil
+	}
+	gopher := visibleBounds(img)
+	for _, o := range overlays {
+		at := image.Pt(
+			gopher.Min.X+int(o.X*float64(gopher.Dx())),
+			gopher.Min.Y+int(o.Y*float64(gopher.Dy())),
+		)
+		switch o.Kind {
+		case OverlaySticker:
+			sticker := stickers[0]
+			stickers = stickers[1:]
+			if sticker == nil {
+				return errors.Errorf("no such sticker: %s", o.Sticker)
+			}
+			w := int(o.Scale * float64(gopher.Dx()))
+			sb := sticker.Bounds()
+			h := w * sb.Dy() / sb.Dx()
+			dst := image.Rect(at.X-w/2, at.Y-h/2, at.X-w/2+w, at.Y-h/2+h)
+			xdraw.CatmullRom.Scale(img, dst, sticker, sb, xdraw.Over, nil)
+		case OverlaySpeech, OverlayThought:
+			if err := drawBubble(img, o.Kind, o.Text, at, gopher); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wrapText breaks text into lines no wider than width.
+func wrapText(face font.Face, text string, width fixed.Int26_6) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		try := word
+		if line != "" {
+			try = line + " " + word
+		}
+		if line != "" && font.MeasureString(face, try) > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line = try
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// drawBubble draws a speech or thought bubble above the gopher with a
+// tail pointing at tip.
+func drawBubble(img *image.RGBA, kind, text string, tip image.Point, gopher image.Rectangle) error {
+	text = strings.TrimSpace(withGlyphs(text))
+	if text == "" {
+		return nil
+	}
+	b := img.Bounds()
+	size := math.Max(float64(gopher.Dx())/14, minTextSize)
+	face, err := fontFace(size)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+	maxWidth := b.Dx() * 2 / 3
+	pad := int(size * 0.8)
+	lines := wrapText(face, text, fixed.I(maxWidth-pad*2))
+	if len(lines) > maxBubbleLines {
+		lines = lines[:maxBubbleLines]
+		lines[maxBubbleLines-1] += "…"
+	}
+	metrics := face.Metrics()
+	lineHeight := (metrics.Ascent + metrics.Descent).Ceil()
+	var textWidth fixed.Int26_6
+	for _, line := range lines {
+		if w := font.MeasureString(face, line); w > textWidth {
+			textWidth = w
+		}
+	}
+	w := textWidth.Ceil() + pad*2
+	h := lineHeight*len(lines) + pad*2
+	// sit the bubble above and beside the tip, inside the image
+	gap := lineHeight * 2
+	x := tip.X - w/4
+	if tip.X > b.Min.X+b.Dx()/2 {
+		x = tip.X - w*3/4
+	}
+	y := tip.Y - gap - h
+	x = clamp(x, b.Min.X, b.Max.X-w)
+	y = clamp(y, b.Min.Y, b.Max.Y-h)
+	box := image.Rect(x, y, x+w, y+h)
+	outline := int(math.Max(2, size/10))
+	black := image.NewUniform(color.Black)
+	white := image.NewUniform(color.White)
+	mouth := image.Pt(clamp(tip.X, box.Min.X+pad, box.Max.X-pad), box.Max.Y)
+	if kind == OverlayThought {
+		// a trail of shrinking circles from the bubble to the tip
+		for i, r := range []int{lineHeight / 2, lineHeight / 3, lineHeight / 5} {
+			t := float64(i+1) / 4
+			c := image.Pt(
+				mouth.X+int(t*float64(tip.X-mouth.X)),
+				mouth.Y+int(t*float64(tip.Y-mouth.Y)),
+			)
+			fillEllipse(img, image.Rect(c.X-r-outline, c.Y-r-outline, c.X+r+outline, c.Y+r+outline), black)
+			fillEllipse(img, image.Rect(c.X-r, c.Y-r, c.X+r, c.Y+r), white)
+		}
+		// an ellipse around the box is about 1.4 times its size
+		cloud := image.Rect(box.Min.X-w/5, box.Min.Y-h/5, box.Max.X+w/5, box.Max.Y+h/5)
+		fillEllipse(img, cloud.Inset(-outline), black)
+		fillEllipse(img, cloud, white)
+	} else {
+		half := pad
+		tail := [3]image.Point{image.Pt(mouth.X-half, mouth.Y-1), image.Pt(mouth.X+half, mouth.Y-1), tip}
+		fillRoundedRect(img, box.Inset(-outline), pad+outline, black)
+		fillTriangle(img, tail, outline, black)
+		fillRoundedRect(img, box, pad, white)
+		fillTriangle(img, tail, 0, white)
+	}
+	d := &font.Drawer{Dst: img, Src: black, Face: face}
+	for i, line := range lines {
+		lw := font.MeasureString(face, line)
+		d.Dot = fixed.Point26_6{
+			X: fixed.I(box.Min.X) + (fixed.I(w)-lw)/2,
+			Y: fixed.I(box.Min.Y+pad+i*lineHeight) + metrics.Ascent,
+		}
+		d.DrawString(line)
+	}
+	return nil
+}
+
+func clamp(n, min, max int) int {
+	if n > max {
+		n = max
+	}
+	if n < min {
+		n = min
+	}
+	return n
+}
+
+// fillRoundedRect fills r with corners of radius rad.
+func fillRoundedRect(dst draw.Image, r image.Rectangle, rad int, src image.Image) {
+	inner := r.Inset(rad)
+	fill(dst, r, src, func(x, y int) bool {
+		cx := clamp(x, inner.Min.X, inner.Max.X)
+		cy := clamp(y, inner.Min.Y, inner.Max.Y)
+		dx, dy := x-cx, y-cy
+		return dx*dx+dy*dy <= rad*rad
+	})
+}
+
+// fillEllipse fills the ellipse inside r.
+func fillEllipse(dst draw.Image, r image.Rectangle, src image.Image) {
+	cx := float64(r.Min.X+r.Max.X) / 2
+	cy := float64(r.Min.Y+r.Max.Y) / 2
+	rx := float64(r.Dx()) / 2
+	ry := float64(r.Dy()) / 2
+	fill(dst, r, src, func(x, y int) bool {
+		dx := (float64(x) + 0.5 - cx) / rx
+		dy := (float64(y) + 0.5 - cy) / ry
+		return dx*dx+dy*dy <= 1
+	})
+}
+
+// fillTriangle fills the triangle, grown by grow pixels.
+func fillTriangle(dst draw.Image, t [3]image.Point, grow int, src image.Image) {
+	r := image.Rectangle{Min: t[0], Max: t[0]}
+	for _, p := range t[1:] {
+		r = r.Union(image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))})
+	}
+	r = r.Inset(-grow)
+	edge := func(a, b image.Point, x, y int) float64 {
+		// signed distance from the line through a and b
+		ex, ey := float64(b.X-a.X), float64(b.Y-a.Y)
+		l := math.Hypot(ex, ey)
+		if l == 0 {
+			return 0
+		}
+		return (ex*float64(y-a.Y) - ey*float64(x-a.X)) / l
+	}
+	sign := 1.0
+	if edge(t[0], t[1], t[2].X, t[2].Y) < 0 {
+		sign = -1
+	}
+	fill(dst, r, src, func(x, y int) bool {
+		for i := range t {
+			if sign*edge(t[i], t[(i+1)%3], x, y) < -float64(grow) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// fill sets the pixels in r for which in is true.
+func fill(dst draw.Image, r image.Rectangle, src image.Image, in func(x, y int) bool) {
+	r = r.Intersect(dst.Bounds())
+	c := src.At(0, 0)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if in(x, y) {
+				dst.Set(x, y, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// Artwork packs are separate sets of artwork, each with their own
+// categories. The default pack, with the empty ID, is the artwork/
+// folder; others are folders under packs/, so the pack retro is in
+// packs/retro/. Item IDs start with their pack's folder, which makes
+// the pack part of every gopher hash and render cache key.
+const packsPrefix = "packs/"
+
+// packConfigFile holds the PackConfig of a pack under packs/.
+const packConfigFile = "pack.json"
+
+// Errors about packs.
+var (
+	// ErrWrongPack is returned for selections with items from another
+	// pack, or from more than one.
+	ErrWrongPack = errors.New("images must all be from the same pack")
+	// ErrPrivatePack is returned when a request may not use a private
+	// pack.
+	ErrPrivatePack = errors.New("that pack is private")
+)
+
+// PackConfig is the pack.json of a pack.
+type PackConfig struct {
+	// Private packs are only listed and rendered for signed in users
+	// in one of Groups, or requests with one of Keys. Renders of them
+	// aren't cached or saved as public gophers.
+	Private bool     `json:"private"`
+	Groups  []string `json:"groups,omitempty"`
+	// Keys are the hex SHA-256 hashes of the API keys that may use the
+	// pack, given in the X-API-Key header or the key parameter.
+	Keys []string `json:"keys,omitempty"`
+	// Width and Height are the size of the artwork, and so of each
+	// frame of a sprite strip. They are only needed if every item is a
+	// strip; otherwise the narrowest item gives the size.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// AccessFunc reports whether the request is from a signed in user in
+// one of the groups.
+type AccessFunc func(r *http.Request, groups []string) bool
+
+var packPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// CheckPack checks a pack ID.
+func CheckPack(pack string) error {
+	if pack != "" && !packPattern.MatchString(pack) {
+		return errors.New("pack IDs must be lowercase letters, numbers and hyphens")
+	}
+	return nil
+}
+
+// packPrefix gets the folder holding the pack's artwork.
+func packPrefix(pack string) string {
+	if pack == "" {
+		return artworkPrefix
+	}
+	return packsPrefix + pack + "/"
+}
+
+// PackOf gets the ID of the pack holding the item.
+func PackOf(id string) string {
+	if !strings.HasPrefix(id, packsPrefix) {
+		return ""
+	}
+	rest := strings.TrimPrefix(id, packsPrefix)
+	if i := strings.Index(rest, "/"); i > 0 {
+		return rest[:i]
+	}
+	return ""
+}
+
+// ImagesPack checks the selection is all items from pack, and gets the
+// pack. An empty pack means the pack of the first item.
+func ImagesPack(images []string, pack string) (string, error) {
+	if err := CheckPack(pack); err != nil {
+		return "", err
+	}
+	first := pack == ""
+	for _, id := range images {
+		if id == "" {
+			continue
+		}
+		if first {
+			pack = PackOf(id)
+			first = false
+		}
+		if PackOf(id) != pack || !strings.HasPrefix(id, packPrefix(pack)) || strings.Contains(id, "..") {
+			return "", ErrWrongPack
+		}
+	}
+	return pack, nil
+}
+
+// readPackConfig reads the pack's pack.json. Packs without one, and
+// the default pack, are public.
+func readPackConfig(ctx context.Context, bucket *storage.BucketHandle, pack string) (PackConfig, error) {
+	var config PackConfig
+	if pack == "" {
+		return config, nil
+	}
+	r, err := bucket.Object(packPrefix(pack) + packConfigFile).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return config, nil
+	}
+	if err != nil {
+		return config, errors.Wrap(err, "read pack config")
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return config, errors.Wrap(err, "decode pack config")
+	}
+	return config, nil
+}
+
+// PackPrivate gets whether the pack is private.
+func PackPrivate(ctx context.Context, pack string) (bool, error) {
+	if pack == "" {
+		return false, nil
+	}
+	catalog, err := loadArtwork(ctx, pack, true)
+	if err != nil {
+		return false, err
+	}
+	return catalog.Config.Private, nil
+}
+
+// checkPack gets whether the pack is private, and ErrPrivatePack if
+// the request may not use it.
+func (s server) checkPack(ctx context.Context, r *http.Request, pack string) (bool, error) {
+	if pack == "" {
+		return false, nil
+	}
+	catalog, err := loadArtwork(ctx, pack, true)
+	if err != nil {
+		return false, err
+	}
+	config := catalog.Config
+	if !config.Private {
+		return false, nil
+	}
+	if key := requestKey(r); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		hashed := []byte(hex.EncodeToString(sum[:]))
+		for _, allowed := range config.Keys {
+			if subtle.ConstantTimeCompare(hashed, []byte(strings.ToLower(allowed))) == 1 {
+				return true, nil
+			}
+		}
+	}
+	if s.inGroups != nil && s.inGroups(r, config.Groups) {
+		return true, nil
+	}
+	log.Infof(ctx, "denied private pack %s", pack)
+	return true, ErrPrivatePack
+}
+
+// requestKey gets the API key the request was made with, if any.
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+// privateRenderURL gets a render URL for an item in a private pack,
+// which isn't public in the bucket. Zero size is the full size.
+func privateRenderURL(id, pack string, size int) string {
+	q := url.Values{
+		"images": []string{id},
+		"pack":   []string{pack},
+		"dl":     []string{"0"},
+	}
+	if size != 0 {
+		q.Set("size", strconv.Itoa(size))
+	}
+	return "/api/render.png?" + q.Encode()
+}
+
+// artworkCacheKey gets the memcache key of a pack's catalog. The
+// default pack keeps the key it always had.
+func artworkCacheKey(pack string) string {
+	if pack == "" {
+		return "artwork"
+	}
+	return "artwork:" + pack
+}
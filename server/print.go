@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	maxRenderScale = 8
+	minDPI         = 72
+	maxDPI         = 2400
+)
+
+// variantScales are the high resolution versions an artwork item may
+// have, such as Feature@2x.png, smallest first.
+var variantScales = []int{2, 4}
+
+var variantPattern = regexp.MustCompile(`@[0-9]+x\.[A-Za-z]+$`)
+
+// variantName gets the name of the object holding the variant of name
+// that is factor times bigger.
+func variantName(name string, factor int) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "@" + strconv.Itoa(factor) + "x" + ext
+}
+
+// isVariant gets whether the object is a high resolution variant of
+// another.
+func isVariant(name string) bool {
+	return variantPattern.MatchString(name)
+}
+
+// width gets the width of the render for artwork that is canvas sized.
+func (o RenderOptions) width(canvas image.Rectangle) int {
+	var w int
+	switch {
+	case o.Size != 0:
+		w = o.Size
+	case o.Scale != 0:
+		w = int(math.Round(float64(canvas.Dx()) * o.Scale))
+	default:
+		return canvas.Dx()
+	}
+	if w > maxRenderSize {
+		w = maxRenderSize
+	}
+	return w
+}
+
+// useVariants swaps layers for the best high resolution variant of
+// their item, which is the smallest at least scale times bigger, or
+// else the biggest there is. Layers without variants are left alone
+// and get upscaled.
+func useVariants(ctx context.Context, images []string, layers []layer, canvas image.Rectangle, scale float64) error {
+	if scale <= 1 {
+		return nil
+	}
+	var names []string
+	for _, name := range images {
+		if name == "" || path.Ext(name) == ".svg" {
+			// vectors are drawn at any size
+			continue
+		}
+		for _, factor := range variantScales {
+			names = append(names, variantName(name, factor))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	loaded, err := LoadImages(ctx, names...)
+	if err != nil {
+		return errors.Wrap(err, "load variants")
+	}
+	variants := make(map[string]image.Image)
+	for i, name := range names {
+		if loaded[i] != nil {
+			variants[name] = loaded[i]
+		}
+	}
+	for i, name := range images {
+		if len(layers[i]) == 0 {
+			continue
+		}
+		var best image.Image
+		var bestFactor int
+		for _, factor := range variantScales {
+			v, ok := variants[variantName(name, factor)]
+			if !ok {
+				continue
+			}
+			best, bestFactor = v, factor
+			if float64(factor) >= scale {
+				break
+			}
+		}
+		if best == nil {
+			continue
+		}
+		want := canvas.Dy() * bestFactor
+		if best.Bounds().Dy() != want {
+			log.Warningf(ctx, "%s: @%dx variant should be %dpx high", name, bestFactor, want)
+			continue
+		}
+		layers[i] = splitStrip(best, canvas.Dx()*bestFactor)
+	}
+	return nil
+}
+
+// scaleText scales the text options, which are in pixels at the
+// artwork's own size.
+func scaleText(t TextOptions, scale float64) TextOptions {
+	t.Size *= scale
+	t.Outline = int(math.Round(float64(t.Outline) * scale))
+	return t
+}
+
+// writePNG writes the encoded PNG or APNG with its provenance and the
+// metadata chunks the options ask for.
+func writePNG(w io.Writer, data []byte, opts RenderOptions, p Provenance) error {
+	data, err := writeProvenance(data, p)
+	if err != nil {
+		return err
+	}
+	if opts.DPI != 0 {
+		// pixels per metre, in both directions
+		phys := make([]byte, 9)
+		ppm := uint32(math.Round(float64(opts.DPI) / 0.0254))
+		binary.BigEndian.PutUint32(phys[0:], ppm)
+		binary.BigEndian.PutUint32(phys[4:], ppm)
+		phys[8] = 1 // unit is the metre
+		if data, err = insertChunk(data, "pHYs", phys); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// insertChunk adds a chunk to the PNG straight after its IHDR chunk.
+func insertChunk(data []byte, typ string, chunk []byte) ([]byte, error) {
+	// signature, then IHDR's length, type, 13 bytes of data and CRC
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return nil, errors.New("not a PNG")
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 12 + len(chunk))
+	buf.Write(data[:ihdrEnd])
+	if err := writeChunk(&buf, typ, chunk); err != nil {
+		return nil, err
+	}
+	buf.Write(data[ihdrEnd:])
+	return buf.Bytes(), nil
+}
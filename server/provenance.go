@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// Text chunk keywords for provenance. Author, Copyright and Software
+// are standard PNG keywords.
+const (
+	keySelection = "gopherize:selection"
+	keyGopher    = "gopherize:gopher"
+	keyCatalog   = "gopherize:catalog"
+	keyPack      = "gopherize:pack"
+	keyOptions   = "gopherize:options"
+	keyAuthor    = "Author"
+	keyCopyright = "Copyright"
+	keySoftware  = "Software"
+
+	// defaultCredit is for artwork without artist metadata.
+	defaultCredit = "Ashley McNamara, inspired by Renee French"
+	// maxDecodeSize is the biggest PNG /api/decode reads.
+	maxDecodeSize = 20 << 20
+	// maxTextChunk is the biggest text chunk read, before and after
+	// decompressing it.
+	maxTextChunk = 1 << 20
+)
+
+// Provenance is where a rendered gopher came from.
+type Provenance struct {
+	// Images is the selection, in layer order.
+	Images []string `json:"images"`
+	// Gopher is the hash of the selection, as used in /gopher/{hash}.
+	Gopher string `json:"gopher"`
+	// Pack is the ID of the artwork pack, which is empty for the
+	// default.
+	Pack string `json:"pack,omitempty"`
+	// Catalog is the version of the artwork catalog it was drawn from.
+	Catalog string `json:"catalog,omitempty"`
+	// Options are the render API parameters besides images.
+	Options url.Values `json:"options,omitempty"`
+	// Credits are the artists of the chosen items.
+	Credits []string `json:"credits,omitempty"`
+	// Licenses are the licenses of the chosen items.
+	Licenses []string `json:"licenses,omitempty"`
+}
+
+// provenance describes a render of images with opts. Credits and the
+// catalog version are left out if the catalog can't be loaded.
+func provenance(ctx context.Context, images []string, opts RenderOptions) Provenance {
+	p := Provenance{
+		Images:  images,
+		Gopher:  Hash(strings.Join(images, "|")),
+		Options: opts.Encode(),
+	}
+	pack, err := ImagesPack(images, "")
+	if err != nil {
+		log.Warningf(ctx, "provenance: %s", err)
+		return p
+	}
+	p.Pack = pack
+	catalog, err := loadArtwork(ctx, pack, true)
+	if err != nil {
+		log.Warningf(ctx, "provenance: load artwork: %s", err)
+		return p
+	}
+	p.Catalog = catalog.Version
+	seen := make(map[string]bool)
+	add := func(list []string, s string) []string {
+		if s == "" || seen[s] {
+			return list
+		}
+		seen[s] = true
+		return append(list, s)
+	}
+	for _, name := range images {
+		img, ok := catalog.image(name)
+		if !ok {
+			continue
+		}
+		artist := img.Artist
+		if artist == "" {
+			artist = defaultCredit
+		}
+		p.Credits = add(p.Credits, artist)
+		p.Licenses = add(p.Licenses, img.License)
+	}
+	return p
+}
+
+// writeProvenance adds text chunks describing p to the PNG.
+func writeProvenance(data []byte, p Provenance) ([]byte, error) {
+	chunks := []struct {
+		key, value string
+	}{
+		{keySoftware, "gopherize.me"},
+		{keySelection, strings.Join(p.Images, "|")},
+		{keyGopher, p.Gopher},
+		{keyPack, p.Pack},
+		{keyCatalog, p.Catalog},
+		{keyOptions, p.Options.Encode()},
+		{keyAuthor, strings.Join(p.Credits, "; ")},
+		{keyCopyright, strings.Join(p.Licenses, "; ")},
+	}
+	// inserted after IHDR, so go backwards to keep them in order
+	for i := len(chunks) - 1; i >= 0; i-- {
+		c := chunks[i]
+		if c.value == "" {
+			continue
+		}
+		var err error
+		if data, err = insertChunk(data, "iTXt", itxt(c.key, c.value)); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// itxt makes the data of an uncompressed iTXt chunk, which holds UTF-8
+// text (tEXt is only Latin-1).
+func itxt(key, value string) []byte {
+	var b bytes.Buffer
+	b.WriteString(key)
+	// null separator, not compressed, compression method, then empty
+	// language tag and translated keyword each ended by a null
+	b.Write([]byte{0, 0, 0, 0, 0})
+	b.WriteString(value)
+	return b.Bytes()
+}
+
+// DecodeProvenance reads the provenance from a PNG rendered by
+// gopherize.me.
+func DecodeProvenance(r io.Reader) (Provenance, error) {
+	var p Provenance
+	text, err := readText(r)
+	if err != nil {
+		return p, err
+	}
+	selection, ok := text[keySelection]
+	if !ok {
+		return p, errors.New("not a gopherize.me image")
+	}
+	p.Images = strings.Split(selection, "|")
+	p.Gopher = text[keyGopher]
+	p.Pack = text[keyPack]
+	p.Catalog = text[keyCatalog]
+	if s := text[keyOptions]; s != "" {
+		if p.Options, err = url.ParseQuery(s); err != nil {
+			return p, errors.Wrap(err, "options")
+		}
+	}
+	if s := text[keyAuthor]; s != "" {
+		p.Credits = strings.Split(s, "; ")
+	}
+	if s := text[keyCopyright]; s != "" {
+		p.Licenses = strings.Split(s, "; ")
+	}
+	return p, nil
+}
+
+// readText reads the tEXt and iTXt chunks of a PNG, keyed by keyword.
+func readText(r io.Reader) (map[string]string, error) {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return nil, errors.New("not a PNG")
+	}
+	text := make(map[string]string)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errors.Wrap(err, "read chunk")
+		}
+		n := binary.BigEndian.Uint32(header[:4])
+		typ := string(header[4:])
+		if typ == "IEND" {
+			return text, nil
+		}
+		if typ != "tEXt" && typ != "iTXt" {
+			// skip the data and CRC
+			if _, err := io.CopyN(ioutil.Discard, r, int64(n)+4); err != nil {
+				return nil, errors.Wrap(err, "read chunk")
+			}
+			continue
+		}
+		// the length comes from the file, so check it before trusting it
+		if n > maxTextChunk {
+			return nil, errors.Errorf("%s chunk is too big", typ)
+		}
+		data := make([]byte, int64(n)+4)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errors.Wrap(err, "read chunk")
+		}
+		data = data[:n]
+		i := bytes.IndexByte(data, 0)
+		if i == -1 {
+			continue
+		}
+		key, value := string(data[:i]), data[i+1:]
+		if typ == "tEXt" {
+			text[key] = latin1(value)
+			continue
+		}
+		if len(value) < 2 {
+			continue
+		}
+		compressed := value[0] == 1
+		value = value[2:]
+		// skip the language tag and translated keyword
+		for skip := 0; skip < 2; skip++ {
+			j := bytes.IndexByte(value, 0)
+			if j == -1 {
+				value = nil
+				break
+			}
+			value = value[j+1:]
+		}
+		if compressed {
+			zr, err := zlib.NewReader(bytes.NewReader(value))
+			if err != nil {
+				continue
+			}
+			value, err = ioutil.ReadAll(io.LimitReader(zr, maxTextChunk+1))
+			if err != nil || len(value) > maxTextChunk {
+				continue
+			}
+		}
+		text[key] = string(value)
+	}
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeHandler reads the provenance of the PNG in the request body.
+func (s server) decodeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Method != http.MethodPost {
+		s.responderr(ctx, w, r, http.StatusMethodNotAllowed, errors.New("POST a PNG"))
+		return
+	}
+	p, err := DecodeProvenance(io.LimitReader(r.Body, maxDecodeSize))
+	if err != nil {
+		s.responderr(ctx, w, r, http.StatusUnprocessableEntity, err)
+		return
+	}
+	edit := url.Values{"images": []string{strings.Join(p.Images, "|")}}
+	if p.Pack != "" {
+		edit.Set("pack", p.Pack)
+	}
+	res := struct {
+		Provenance
+		EditURL   string `json:"edit_url"`
+		RenderURL string `json:"render_url"`
+	}{
+		Provenance: p,
+		EditURL:    "/?" + edit.Encode(),
+	}
+	render := url.Values{}
+	for k, v := range p.Options {
+		render[k] = v
+	}
+	render.Set("images", edit.Get("images"))
+	if p.Pack != "" {
+		render.Set("pack", p.Pack)
+	}
+	res.RenderURL = "/api/render.png?" + render.Encode()
+	s.respond(ctx, w, r, http.StatusOK, res)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// testPNG encodes a small image as a PNG.
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProvenanceRoundTrip(t *testing.T) {
+	p := Provenance{
+		Images:   []string{"artwork/010-Body/blue_gopher.png", "artwork/020-Eyes/crazy_eyes.png"},
+		Gopher:   "0123456789abcdef",
+		Pack:     "space",
+		Catalog:  "v1",
+		Options:  url.Values{"size": {"300"}, "text": {"Mat & Renée"}},
+		Credits:  []string{"Ashley McNamara", "Zoë"},
+		Licenses: []string{"CC BY 4.0"},
+	}
+	data, err := writeProvenance(testPNG(t), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeProvenance(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+	// the image itself is untouched
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 4, 3) {
+		t.Errorf("got bounds %v", img.Bounds())
+	}
+}
+
+func TestProvenanceChunkCRC(t *testing.T) {
+	data, err := writeProvenance(testPNG(t), Provenance{Images: []string{"artwork/010-Body/blue_gopher.png"}, Gopher: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for rest := data[len(pngSignature):]; len(rest) > 0; {
+		n := binary.BigEndian.Uint32(rest)
+		typ, body := rest[4:8], rest[8:8+n]
+		crc := crc32.NewIEEE()
+		crc.Write(typ)
+		crc.Write(body)
+		if got, want := binary.BigEndian.Uint32(rest[8+n:]), crc.Sum32(); got != want {
+			t.Errorf("%s: got CRC %08x, want %08x", typ, got, want)
+		}
+		types = append(types, string(typ))
+		rest = rest[12+n:]
+	}
+	// after IHDR, in the order written
+	want := []string{"IHDR", "iTXt", "iTXt", "iTXt", "IDAT", "IEND"}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("got chunks %v, want %v", types, want)
+	}
+}
+
+func TestReadText(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("squashed"))
+	zw.Close()
+	ztxt := append([]byte("zipped\x00\x01\x00en\x00\x00"), compressed.Bytes()...)
+	data := testPNG(t)
+	for _, c := range []struct {
+		typ  string
+		data []byte
+	}{
+		{"tEXt", []byte("latin\x00caf\xe9")},
+		{"iTXt", itxt("plain", "héllo")},
+		{"iTXt", ztxt},
+		{"tEXt", []byte("no separator")},
+	} {
+		var err error
+		if data, err = insertChunk(data, c.typ, c.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := readText(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"latin": "café", "plain": "héllo", "zipped": "squashed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadTextErrors(t *testing.T) {
+	big := testPNG(t)
+	// claim a text chunk far bigger than allowed
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, maxTextChunk+1)
+	copy(header[4:], "tEXt")
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	big = append(append(append([]byte{}, big[:ihdrEnd]...), header...), big[ihdrEnd:]...)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not a PNG", []byte("GIF89a...")},
+		{"truncated", testPNG(t)[:20]},
+		{"chunk too big", big},
+	}
+	for _, test := range tests {
+		if _, err := readText(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+	if _, err := DecodeProvenance(bytes.NewReader(testPNG(t))); err == nil {
+		t.Error("plain PNG: got no error")
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	// anonymousRate and anonymousBurst limit render requests without an
+	// API key, per IP address, in requests a minute.
+	anonymousRate  = 60
+	anonymousBurst = 20
+	// maxMemoryBuckets is how many buckets a MemoryRateStore holds
+	// before it forgets the least recently used.
+	maxMemoryBuckets = 10000
+	// casAttempts is how many times MemcacheRateStore tries to update
+	// a bucket before letting the request through.
+	casAttempts = 5
+)
+
+// RateStore holds token buckets for rate limiting. Stores backed by
+// anything with atomic updates, such as memcache or Redis, can be
+// shared by every instance.
+type RateStore interface {
+	// Take takes n tokens from the bucket named key, which refills at
+	// rate tokens a second up to burst. It gets zero if there was a
+	// token, otherwise how long until there will be. Taking more
+	// tokens than there are leaves the bucket owing the rest.
+	Take(ctx context.Context, key string, rate float64, burst, n int) (time.Duration, error)
+}
+
+// tokenBucket is the state of a bucket. Tokens is what it held at
+// Last.
+type tokenBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// take refills the bucket up to now and takes n tokens if there is at
+// least one, or gets how long until there will be one.
+func (b *tokenBucket) take(now time.Time, rate float64, burst, n int) time.Duration {
+	if b.Last.IsZero() {
+		b.Tokens = float64(burst)
+	} else if elapsed := now.Sub(b.Last).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(burst), b.Tokens+elapsed*rate)
+	}
+	b.Last = now
+	if b.Tokens >= 1 {
+		b.Tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+}
+
+// full gets whether the bucket will have refilled by now.
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+	return b.Tokens+now.Sub(b.Last).Seconds()*rate >= float64(burst)
+}
+
+// MemoryRateStore keeps buckets in the instance, so each instance
+// limits on its own.
+type MemoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// used holds the buckets, least recently used at the back.
+	used *list.List
+}
+
+type memoryBucket struct {
+	tokenBucket
+	key   string
+	rate  float64
+	burst int
+}
+
+// NewMemoryRateStore makes an empty MemoryRateStore.
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{
+		buckets: make(map[string]*list.Element),
+		used:    list.New(),
+	}
+}
+
+// Take takes n tokens from the bucket.
+func (m *MemoryRateStore) Take(ctx context.Context, key string, rate float64, burst, n int) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e, ok := m.buckets[key]
+	if ok {
+		m.used.MoveToFront(e)
+	} else {
+		e = m.used.PushFront(&memoryBucket{key: key})
+		m.buckets[key] = e
+	}
+	b := e.Value.(*memoryBucket)
+	b.rate, b.burst = rate, burst
+	wait := b.take(now, rate, burst, n)
+	// full buckets are the same as missing ones, and past the limit
+	// the least recently used are forgotten even if they aren't
+	for last := m.used.Back(); last != e; last = m.used.Back() {
+		lb := last.Value.(*memoryBucket)
+		if len(m.buckets) <= maxMemoryBuckets && !lb.full(now, lb.rate, lb.burst) {
+			break
+		}
+		m.used.Remove(last)
+		delete(m.buckets, lb.key)
+	}
+	return wait, nil
+}
+
+// MemcacheRateStore keeps buckets in memcache, shared by every
+// instance. Buckets are updated with compare and swap; requests are let
+// through if memcache is too busy to update them.
+type MemcacheRateStore struct{}
+
+// Take takes n tokens from the bucket.
+func (MemcacheRateStore) Take(ctx context.Context, key string, rate float64, burst, n int) (time.Duration, error) {
+	key = "ratelimit:" + key
+	// by the time it expires the bucket would be full anyway
+	expiration := time.Duration(float64(burst)/rate*float64(time.Second)) + time.Minute
+	for attempt := 0; attempt < casAttempts; attempt++ {
+		var b tokenBucket
+		item, err := memcache.Gob.Get(ctx, key, &b)
+		if err == memcache.ErrCacheMiss {
+			wait := b.take(time.Now(), rate, burst, n)
+			err = memcache.Gob.Add(ctx, &memcache.Item{Key: key, Object: b, Expiration: expiration})
+			if err == memcache.ErrNotStored {
+				// someone else made it first
+				continue
+			}
+			return wait, err
+		}
+		if err != nil {
+			return 0, err
+		}
+		wait := b.take(time.Now(), rate, burst, n)
+		item.Object = b
+		item.Expiration = expiration
+		err = memcache.Gob.CompareAndSwap(ctx, item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return wait, err
+	}
+	log.Warningf(ctx, "rate limit %s: too much contention", key)
+	return 0, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2017, 12, 24, 12, 0, 0, 0, time.UTC)
+	const rate, burst = 1.0, 3
+	var b tokenBucket
+	steps := []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		// a new bucket starts full
+		{0, 0},
+		{0, 0},
+		{0, 0},
+		{0, time.Second},
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, 0},
+		{time.Second, time.Second},
+		// it refills no higher than burst
+		{time.Minute, 0},
+		{time.Minute, 0},
+		{time.Minute, 0},
+		{time.Minute, time.Second},
+	}
+	for i, step := range steps {
+		if got := b.take(start.Add(step.at), rate, burst, 1); got != step.want {
+			t.Errorf("%d: take at %s: got %s, want %s", i, step.at, got, step.want)
+		}
+	}
+}
+
+func TestTokenBucketTakeMany(t *testing.T) {
+	start := time.Date(2017, 12, 24, 12, 0, 0, 0, time.UTC)
+	const rate, burst = 1.0, 5
+	var b tokenBucket
+	// a big request is let through, but leaves the bucket owing
+	if got := b.take(start, rate, burst, 8); got != 0 {
+		t.Errorf("take 8: got %s, want no wait", got)
+	}
+	if got := b.take(start, rate, burst, 1); got != 4*time.Second {
+		t.Errorf("take after: got %s, want 4s", got)
+	}
+	if got := b.take(start.Add(4*time.Second), rate, burst, 1); got != 0 {
+		t.Errorf("take once repaid: got %s, want no wait", got)
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	start := time.Date(2017, 12, 24, 12, 0, 0, 0, time.UTC)
+	var b tokenBucket
+	b.take(start, 2, 4, 1)
+	if b.full(start, 2, 4) {
+		t.Error("full straight after a take")
+	}
+	if b.full(start.Add(499*time.Millisecond), 2, 4) {
+		t.Error("full before it has refilled")
+	}
+	if !b.full(start.Add(500*time.Millisecond), 2, 4) {
+		t.Error("not full once it has refilled")
+	}
+}
+
+func TestMemoryRateStoreTake(t *testing.T) {
+	m := NewMemoryRateStore()
+	// a token a minute, so none come back during the test
+	const rate, burst = 1.0 / 60, 2
+	for i := 0; i < burst; i++ {
+		if wait, err := m.Take(context.Background(), "a", rate, burst, 1); err != nil || wait != 0 {
+			t.Fatalf("take %d: got %s, %v, want no wait", i, wait, err)
+		}
+	}
+	if wait, _ := m.Take(context.Background(), "a", rate, burst, 1); wait <= 0 || wait > time.Minute {
+		t.Errorf("take past burst: got %s, want up to a minute", wait)
+	}
+	if wait, _ := m.Take(context.Background(), "b", rate, burst, 1); wait != 0 {
+		t.Errorf("other bucket: got %s, want no wait", wait)
+	}
+}
+
+func TestMemoryRateStoreEviction(t *testing.T) {
+	m := NewMemoryRateStore()
+	const rate, burst = 1.0 / 60, 5
+	for i := 0; i < maxMemoryBuckets; i++ {
+		m.Take(context.Background(), fmt.Sprint(i), rate, burst, 1)
+	}
+	// using 0 again makes 1 the least recently used
+	m.Take(context.Background(), "0", rate, burst, 1)
+	m.Take(context.Background(), "new", rate, burst, 1)
+	if len(m.buckets) != maxMemoryBuckets || m.used.Len() != maxMemoryBuckets {
+		t.Fatalf("got %d buckets and %d in the list, want %d", len(m.buckets), m.used.Len(), maxMemoryBuckets)
+	}
+	for key, want := range map[string]bool{"0": true, "1": false, "2": true, "new": true} {
+		if _, ok := m.buckets[key]; ok != want {
+			t.Errorf("bucket %s kept: got %v, want %v", key, ok, want)
+		}
+	}
+	// 0 is still limited, as it wasn't forgotten
+	for i := 0; i < burst-2; i++ {
+		m.Take(context.Background(), "0", rate, burst, 1)
+	}
+	if wait, _ := m.Take(context.Background(), "0", rate, burst, 1); wait == 0 {
+		t.Error("bucket 0 was reset")
+	}
+}
+
+func TestMemoryRateStoreForgetsFull(t *testing.T) {
+	m := NewMemoryRateStore()
+	// these refill straight away
+	for i := 0; i < 100; i++ {
+		m.Take(context.Background(), fmt.Sprint(i), 1e9, 5, 1)
+	}
+	if len(m.buckets) > 1 {
+		t.Errorf("got %d buckets, want full ones forgotten", len(m.buckets))
+	}
+}
@@ -3,12 +3,13 @@ package server
 import (
 	"bytes"
 	"image"
-	"image/draw"
 	"image/png"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
@@ -19,50 +20,212 @@ import (
 	"google.golang.org/appengine/memcache"
 )
 
-type stack []image.Image
-
-func Render(ctx context.Context, w io.Writer, images []string) error {
-	bucket, err := file.DefaultBucketName(ctx)
+// Render stacks the images in order, applies the options and writes
+// the result as a PNG.
+func Render(ctx context.Context, w io.Writer, images []string, opts RenderOptions) error {
+	output, err := RenderImage(ctx, images, opts)
 	if err != nil {
-		err = errors.Wrap(err, "DefaultBucketName")
 		return err
 	}
-	client, err := storage.NewClient(ctx)
+	// encode into a buffer
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, output); err != nil {
+		log.Errorf(ctx, "PNG encode: %s", err)
+		return err
+	}
+	return writePNG(w, buf.Bytes(), opts, provenance(ctx, images, opts))
+}
+
+// ErrTooBig is returned for renders with more pixels over all their
+// frames than maxRenderPixels.
+var ErrTooBig = errors.New("render is too big - make it narrower, or use less animated artwork")
+
+// RenderImage stacks the images in order and applies the options.
+// Animated items show their first frame.
+func RenderImage(ctx context.Context, images []string, opts RenderOptions) (*image.RGBA, error) {
+	var output *image.RGBA
+	err := renderFrames(ctx, images, opts, 1, func(i, n int, frame *image.RGBA) error {
+		output = frame
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// catalogCanvas gets the size of the artwork in the pack, which is
+// empty if the catalog doesn't know it.
+func catalogCanvas(ctx context.Context, pack string) (image.Rectangle, error) {
+	catalog, err := loadArtwork(ctx, pack, true)
+	if err != nil {
+		return image.Rectangle{}, errors.Wrap(err, "load artwork")
+	}
+	return image.Rect(0, 0, catalog.Width, catalog.Height), nil
+}
+
+// renderFrames stacks the images in order, frame by frame, and applies
+// the options to each of up to max frames. Static artwork gives a
+// single frame. Each frame is passed to fn as it is made, with its
+// index and the number of frames, so they needn't all be held at once.
+func renderFrames(ctx context.Context, images []string, opts RenderOptions, max int, fn func(i, n int, frame *image.RGBA) error) error {
+	imgObjects, err := LoadImages(ctx, images...)
 	if err != nil {
-		err = errors.Wrap(err, "storage.NewClient")
 		return err
 	}
-	imgObjects := loadimages(ctx, client.Bucket(bucket), images...)
-	var first image.Image
+	var found bool
 	for _, img := range imgObjects {
-		if img == nil {
-			continue
+		if img != nil {
+			found = true
+			break
 		}
-		first = img
-		break
 	}
-	if first == nil {
+	if !found {
 		// couldn't find a single image!
-		err = errors.Wrap(err, "Artwork is being updated - please try again later")
+		return errors.New("Artwork is being updated - please try again later")
+	}
+	stickers, err := loadStickers(ctx, opts.Overlays)
+	if err != nil {
 		return err
 	}
-	output := image.NewRGBA(first.Bounds())
-	for _, img := range imgObjects {
-		if img == nil {
-			// skip missing images
-			continue
-		}
-		draw.Draw(output, output.Bounds(), img, image.ZP, draw.Over)
+	pack, err := ImagesPack(images, "")
+	if err != nil {
+		return err
 	}
-	// encode into a buffer
-	if err := png.Encode(w, output); err != nil {
-		log.Errorf(ctx, "PNG encode: %s", err)
+	canvas, err := catalogCanvas(ctx, pack)
+	if err != nil {
 		return err
 	}
+	canvas, layers := splitFrames(canvas, imgObjects)
+	text := opts.Text
+	if width := opts.width(canvas); width != canvas.Dx() {
+		scale := float64(width) / float64(canvas.Dx())
+		if err := useVariants(ctx, images, layers, canvas, scale); err != nil {
+			return err
+		}
+		canvas, layers = resizeLayers(canvas, layers, width)
+		if text != nil {
+			scaled := scaleText(*text, scale)
+			text = &scaled
+		}
+	}
+	n := frameCount(layers)
+	if n > max {
+		n = max
+	}
+	if canvas.Dx()*canvas.Dy()*n > maxRenderPixels {
+		return ErrTooBig
+	}
+	for i := 0; i < n; i++ {
+		output := composeFrame(canvas, layers, i)
+		if err := drawOverlays(output, opts.Overlays, stickers); err != nil {
+			return errors.Wrap(err, "draw overlays")
+		}
+		if text != nil {
+			if output, err = DrawText(output, *text); err != nil {
+				return errors.Wrap(err, "draw text")
+			}
+		}
+		if err := fn(i, n, output); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s server) renderHandler(w http.ResponseWriter, r *http.Request) {
+// RenderAnimation renders the images and writes them as an animated
+// GIF or APNG, depending on format. Frames are encoded as they are
+// rendered.
+func RenderAnimation(ctx context.Context, w io.Writer, images []string, opts RenderOptions, format string) error {
+	if format != FormatGIF && format != FormatAPNG {
+		return errors.Errorf("unsupported animation format %q", format)
+	}
+	delay := opts.FrameDelay
+	if delay == 0 {
+		delay = defaultFrameDelay
+	}
+	// APNGs get provenance chunks added once they are whole
+	var buf bytes.Buffer
+	var enc frameEncoder
+	err := renderFrames(ctx, images, opts, maxFrames, func(i, n int, frame *image.RGBA) error {
+		if enc == nil {
+			if format == FormatGIF {
+				enc = &gifEncoder{w: w, delay: delay}
+			} else {
+				var err error
+				if enc, err = newAPNGEncoder(&buf, frame.Bounds(), n, delay); err != nil {
+					return err
+				}
+			}
+		}
+		return enc.WriteFrame(frame)
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if format == FormatGIF {
+		return nil
+	}
+	return writePNG(w, buf.Bytes(), opts, provenance(ctx, images, opts))
+}
+
+// Render formats.
+const (
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatAPNG = "apng"
+	FormatSVG  = "svg"
+)
+
+var formatContentTypes = map[string]string{
+	FormatPNG:  "image/png",
+	FormatGIF:  "image/gif",
+	FormatAPNG: "image/apng",
+	FormatSVG:  svgContentType,
+}
+
+// renderGenerationKey holds the generation of the render caches.
+const renderGenerationKey = "render-generation"
+
+// renderCacheKey gets the memcache key for a render in the generation.
+func renderCacheKey(generation, imagesStr string, opts RenderOptions, format string) string {
+	return "render:" + generation + ":" + format + ":" + Hash(imagesStr+"?"+opts.Encode().Encode())
+}
+
+// renderGeneration gets the generation of the render caches, which
+// starts a new one if memcache has lost it. Renders and sheets are
+// cached under keys in it, so a new generation purges them all.
+func renderGeneration(ctx context.Context) string {
+	if item, err := memcache.Get(ctx, renderGenerationKey); err == nil {
+		return string(item.Value)
+	}
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	err := memcache.Add(ctx, &memcache.Item{Key: renderGenerationKey, Value: []byte(generation)})
+	if err == memcache.ErrNotStored {
+		// another request started it first
+		if item, err := memcache.Get(ctx, renderGenerationKey); err == nil {
+			return string(item.Value)
+		}
+	} else if err != nil {
+		log.Warningf(ctx, "memcache add: %s", err)
+	}
+	return generation
+}
+
+// PurgeRenders starts a new generation of the render caches, so every
+// render and sheet is made again. It gets the new generation.
+func PurgeRenders(ctx context.Context) (string, error) {
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := memcache.Set(ctx, &memcache.Item{Key: renderGenerationKey, Value: []byte(generation)}); err != nil {
+		return "", errors.Wrap(err, "purge renders")
+	}
+	return generation, nil
+}
+
+func (s server) renderHandler(w http.ResponseWriter, r *http.Request, format string) {
 	q := r.URL.Query()
 	imagesStr := q.Get("images")
 	images := strings.Split(imagesStr, "|")
@@ -70,26 +233,94 @@ func (s server) renderHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Must specify at least one image", http.StatusBadRequest)
 		return
 	}
+	pack, err := ImagesPack(images, q.Get("pack"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := ParseRenderOptions(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	ctx := appengine.NewContext(r)
-	cacheItem, err := memcache.Get(ctx, imagesStr)
-	if err == nil {
-		// exit early - from cache
-		log.Debugf(ctx, "cache hit: %s", imagesStr)
-		s.respondWithPng(ctx, w, r, cacheItem.Value)
+	// signed URLs render exactly what was approved, for anyone
+	signed := q.Get("sig") != ""
+	if signed {
+		if err := verifySignature(ctx, format, q, opts); err == ErrBadSignature || err == ErrExpiredSignature {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Errorf(ctx, "verify signature: %s", err)
+			http.Error(w, "Failed to render image :(", http.StatusInternalServerError)
+			return
+		}
+	}
+	private, err := s.checkPack(ctx, r, pack)
+	if err == ErrPrivatePack && signed {
+		err = nil
+	}
+	if err == ErrPrivatePack {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "check pack: %s", err)
+		http.Error(w, "Failed to render image :(", http.StatusInternalServerError)
+		return
+	}
+	if private {
+		// private renders stay out of shared caches
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	client, ok := s.client(ctx, w, r)
+	if !ok {
+		return
+	}
+	cacheKey := renderCacheKey(renderGeneration(ctx), imagesStr, opts, format)
+	if !private {
+		if cacheItem, err := memcache.Get(ctx, cacheKey); err == nil {
+			// exit early - from cache
+			log.Debugf(ctx, "cache hit: %s", imagesStr)
+			s.respondWithImage(ctx, w, r, format, cacheItem.Value)
+			return
+		}
+	}
+	// only renders count towards the rate limit, as cache hits are cheap
+	if !signed && !s.take(ctx, w, client, 1) {
 		return
 	}
 	log.Debugf(ctx, "cache miss - generating image")
 	var buf bytes.Buffer
-	if err := Render(ctx, &buf, images); err != nil {
+	switch format {
+	case FormatPNG:
+		err = Render(ctx, &buf, images, opts)
+	case FormatSVG:
+		err = RenderSVG(ctx, &buf, images, opts)
+	default:
+		err = RenderAnimation(ctx, &buf, images, opts, format)
+	}
+	if err == ErrNotVector {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err == ErrTooBig {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
 		log.Errorf(ctx, "render: %s", err)
 		http.Error(w, "Failed to render image :(", http.StatusInternalServerError)
 		return
 	}
 	// write buffer as response
-	s.respondWithPng(ctx, w, r, buf.Bytes())
+	s.respondWithImage(ctx, w, r, format, buf.Bytes())
+	if private {
+		return
+	}
 	// put result in cache
-	cacheItem = &memcache.Item{
-		Key:   imagesStr,
+	cacheItem := &memcache.Item{
+		Key:   cacheKey,
 		Value: buf.Bytes(),
 	}
 	if err := memcache.Set(ctx, cacheItem); err != nil {
@@ -98,15 +329,47 @@ func (s server) renderHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s server) respondWithPng(ctx context.Context, w http.ResponseWriter, r *http.Request, data []byte) {
-	w.Header().Set("Content-Type", "image/png")
+	s.respondWithImage(ctx, w, r, FormatPNG, data)
+}
+
+func (s server) respondWithImage(ctx context.Context, w http.ResponseWriter, r *http.Request, format string, data []byte) {
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	if format == FormatSVG {
+		// SVGs are documents, so nothing in one may run or load
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
 	if r.URL.Query().Get("dl") == "0" {
 		w.Header().Set("Content-Disposition", "inline")
 	} else {
-		w.Header().Set("Content-Disposition", "attachment; filename=gopherizeme.png;")
+		w.Header().Set("Content-Disposition", "attachment; filename=gopherizeme."+format+";")
 	}
 	if _, err := w.Write(data); err != nil {
-		log.Warningf(ctx, "write png: %s", err)
+		log.Warningf(ctx, "write %s: %s", format, err)
+	}
+}
+
+// Bucket gets the app's default bucket, which holds the artwork.
+func Bucket(ctx context.Context) (*storage.BucketHandle, error) {
+	bucket, err := file.DefaultBucketName(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "DefaultBucketName")
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "storage.NewClient")
+	}
+	return client.Bucket(bucket), nil
+}
+
+// LoadImages reads and decodes the named objects from the default
+// bucket. Images that can't be loaded are nil.
+func LoadImages(ctx context.Context, names ...string) ([]image.Image, error) {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return loadimages(ctx, bucket, names...), nil
 }
 
 func loadimages(ctx context.Context, bucket *storage.BucketHandle, names ...string) []image.Image {
@@ -11,20 +11,57 @@ import (
 	"google.golang.org/appengine/log"
 )
 
-// New makes a new server.
-func New() http.Handler {
-	return cors.New(&server{})
+// New makes a new server. inGroups decides who may use private
+// artwork packs besides those with an API key, and rates holds the
+// render rate limits; either may be nil.
+func New(inGroups AccessFunc, rates RateStore) http.Handler {
+	return cors.New(&server{inGroups: inGroups, rates: rates})
 }
 
-type server struct{}
+type server struct {
+	inGroups AccessFunc
+	rates    RateStore
+}
 
 func (s server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/artwork/stats" {
+		s.artworkStatsHandler(w, r)
+		return
+	}
 	if strings.HasPrefix(r.URL.Path, "/api/artwork") {
 		s.artworkHandler(w, r)
 		return
 	}
 	if r.URL.Path == "/api/render" || r.URL.Path == "/api/render.png" {
-		s.renderHandler(w, r)
+		s.renderHandler(w, r, FormatPNG)
+		return
+	}
+	if r.URL.Path == "/api/render.gif" {
+		s.renderHandler(w, r, FormatGIF)
+		return
+	}
+	if r.URL.Path == "/api/render.apng" {
+		s.renderHandler(w, r, FormatAPNG)
+		return
+	}
+	if r.URL.Path == "/api/render.svg" {
+		s.renderHandler(w, r, FormatSVG)
+		return
+	}
+	if r.URL.Path == "/api/decode" {
+		s.decodeHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/api/identify" {
+		s.identifyHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/api/sheet.png" {
+		s.sheetHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/api/sheet.json" {
+		s.sheetLayoutHandler(w, r)
 		return
 	}
 	http.NotFound(w, r)
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// SheetOptions control the layout of a contact sheet.
+type SheetOptions struct {
+	// Columns is the number of cells in each row.
+	Columns int
+	// CellSize is the width and height in pixels each image is scaled
+	// to fit.
+	CellSize int
+	// Gutter is the space in pixels around and between cells.
+	Gutter int
+	// Labels are drawn under each image, if given.
+	Labels []string
+	// FontSize is the size of the labels in pixels.
+	FontSize float64
+	// Background fills the sheet. Transparent if nil.
+	Background color.Color
+}
+
+// SheetCell is the position of an image in a contact sheet.
+type SheetCell struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Label  string `json:"label,omitempty"`
+}
+
+// labelHeight gets the height of the band under each cell for its
+// label, or zero if there are no labels.
+func (o SheetOptions) labelHeight() int {
+	if len(o.Labels) == 0 {
+		return 0
+	}
+	return int(o.FontSize*1.5 + 0.5)
+}
+
+// Layout gets the size of a contact sheet of n images, and the
+// position of each image on it.
+func (o SheetOptions) Layout(n int) (image.Rectangle, []SheetCell) {
+	cols := o.Columns
+	if cols > n {
+		cols = n
+	}
+	if cols < 1 {
+		cols = 1
+	}
+	rows := (n + cols - 1) / cols
+	rowHeight := o.CellSize + o.labelHeight()
+	cells := make([]SheetCell, n)
+	for i := range cells {
+		cells[i] = SheetCell{
+			X:      o.Gutter + (i%cols)*(o.CellSize+o.Gutter),
+			Y:      o.Gutter + (i/cols)*(rowHeight+o.Gutter),
+			Width:  o.CellSize,
+			Height: o.CellSize,
+		}
+		if i < len(o.Labels) {
+			cells[i].Label = o.Labels[i]
+		}
+	}
+	bounds := image.Rect(0, 0,
+		o.Gutter+cols*(o.CellSize+o.Gutter),
+		o.Gutter+rows*(rowHeight+o.Gutter),
+	)
+	return bounds, cells
+}
+
+// Sheet draws the images in a grid. Nil images leave their cell
+// empty.
+func Sheet(images []image.Image, opts SheetOptions) (*image.RGBA, []SheetCell, error) {
+	if opts.CellSize < 1 {
+		return nil, nil, errors.New("cell size must be positive")
+	}
+	bounds, cells := opts.Layout(len(images))
+	sheet := image.NewRGBA(bounds)
+	if opts.Background != nil {
+		draw.Draw(sheet, bounds, image.NewUniform(opts.Background), image.Point{}, draw.Src)
+	}
+	var face font.Face
+	if opts.labelHeight() > 0 {
+		var err error
+		face, err = fontFace(opts.FontSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer face.Close()
+	}
+	for i, img := range images {
+		cell := cells[i]
+		if img != nil {
+			dst := fit(img.Bounds(), image.Rect(cell.X, cell.Y, cell.X+cell.Width, cell.Y+cell.Height))
+			xdraw.CatmullRom.Scale(sheet, dst, img, img.Bounds(), xdraw.Over, nil)
+		}
+		if face != nil && cell.Label != "" {
+			drawLabel(sheet, face, cell.Label, cell.X, cell.Y+cell.Height, cell.Width, opts.labelHeight())
+		}
+	}
+	return sheet, cells, nil
+}
+
+// EncodeSheet draws the images in a grid and writes it as a PNG.
+func EncodeSheet(w io.Writer, images []image.Image, opts SheetOptions) ([]SheetCell, error) {
+	sheet, cells, err := Sheet(images, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := png.Encode(w, sheet); err != nil {
+		return nil, errors.Wrap(err, "PNG encode")
+	}
+	return cells, nil
+}
+
+// fit gets the largest rectangle with the aspect ratio of src centered
+// in dst.
+func fit(src, dst image.Rectangle) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+	dw, dh := dst.Dx(), dst.Dy()
+	if sw == 0 || sh == 0 {
+		return image.Rectangle{}
+	}
+	w, h := dw, sh*dw/sw
+	if h > dh {
+		w, h = sw*dh/sh, dh
+	}
+	x := dst.Min.X + (dw-w)/2
+	y := dst.Min.Y + (dh-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// drawLabel draws text centered in the band at x, y, shortening it
+// with an ellipsis if it is too wide.
+func drawLabel(dst draw.Image, face font.Face, text string, x, y, width, height int) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(color.Black),
+		Face: face,
+	}
+	max := fixed.I(width)
+	text = withGlyphs(text)
+	runes := []rune(text)
+	for len(runes) > 0 && d.MeasureString(string(runes)) > max {
+		runes = runes[:len(runes)-1]
+		text = string(runes) + "…"
+		if d.MeasureString(text) <= max {
+			break
+		}
+	}
+	if len(runes) == 0 {
+		return
+	}
+	metrics := face.Metrics()
+	textWidth := d.MeasureString(text)
+	d.Dot = fixed.Point26_6{
+		X: fixed.I(x) + (max-textWidth)/2,
+		Y: fixed.I(y) + (fixed.I(height)+metrics.Ascent-metrics.Descent)/2,
+	}
+	d.DrawString(text)
+}
+
+// Limits on contact sheets from the API.
+const (
+	maxSheetCells    = 100
+	maxSheetCellSize = 1000
+	maxSheetGutter   = 100
+	// maxSheetPixels is the largest sheet drawn, as it is held in
+	// memory four bytes a pixel.
+	maxSheetPixels = 16000000
+)
+
+var gopherHashPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// IsGopherHash gets whether s looks like the hash of a gopher.
+func IsGopherHash(s string) bool {
+	return gopherHashPattern.MatchString(s)
+}
+
+// GopherObject gets the name of the object holding the saved image of
+// the gopher with the given hash. It is the gopher's first render, which
+// later saves of the same selection keep even if the artwork changes.
+func GopherObject(gopherHash string) string {
+	return "gophers/" + gopherHash + ".png"
+}
+
+// sheetCell is a SheetCell with the source of its image.
+type sheetCell struct {
+	SheetCell
+	Gopher string   `json:"gopher,omitempty"`
+	Images []string `json:"images,omitempty"`
+}
+
+type sheetResponse struct {
+	Width  int         `json:"width"`
+	Height int         `json:"height"`
+	Cells  []sheetCell `json:"cells"`
+}
+
+// sheetRequest reads a contact sheet request. Cells are made from each
+// `gopher` hash and then each `images` selection, in order. Each
+// selection must be from the `pack`, or a single pack if it is missing.
+// Options are:
+//
+//	cols   - cells per row (default 6)
+//	size   - cell width and height in pixels (default 200)
+//	gutter - space between cells in pixels (default 10)
+//	label  - a label for each cell, in order
+//	font   - label size in pixels (default size/10)
+func sheetRequest(r *http.Request) ([]sheetCell, SheetOptions, error) {
+	q := r.URL.Query()
+	var cells []sheetCell
+	for _, gopher := range q["gopher"] {
+		if !IsGopherHash(gopher) {
+			return nil, SheetOptions{}, errors.Errorf("bad gopher hash: %q", gopher)
+		}
+		cells = append(cells, sheetCell{Gopher: gopher})
+	}
+	for _, images := range q["images"] {
+		cell := sheetCell{Images: strings.Split(images, "|")}
+		if _, err := ImagesPack(cell.Images, q.Get("pack")); err != nil {
+			return nil, SheetOptions{}, err
+		}
+		cells = append(cells, cell)
+	}
+	opts := SheetOptions{
+		Columns:  intParam(q.Get("cols"), 6, 1, maxSheetCells),
+		CellSize: intParam(q.Get("size"), 200, 1, maxSheetCellSize),
+		Gutter:   intParam(q.Get("gutter"), 10, 0, maxSheetGutter),
+		Labels:   q["label"],
+	}
+	opts.FontSize = float64(intParam(q.Get("font"), opts.CellSize/10, 6, 200))
+	if len(cells) == 0 {
+		return nil, opts, errors.New("must specify at least one gopher or images")
+	}
+	if len(cells) > maxSheetCells {
+		return nil, opts, errors.Errorf("at most %d cells", maxSheetCells)
+	}
+	for i := range q["label"] {
+		if utf8.RuneCountInString(q["label"][i]) > 60 {
+			return nil, opts, errors.New("labels must be 60 characters or fewer")
+		}
+	}
+	bounds, _ := opts.Layout(len(cells))
+	if bounds.Dx()*bounds.Dy() > maxSheetPixels {
+		return nil, opts, errors.Errorf("sheet would be %dx%d - at most %d pixels, so use fewer or smaller cells", bounds.Dx(), bounds.Dy(), maxSheetPixels)
+	}
+	return cells, opts, nil
+}
+
+// sheetParams are the parameters that change a contact sheet.
+var sheetParams = []string{"gopher", "images", "pack", "cols", "size", "gutter", "label", "font"}
+
+// sheetCacheKey gets the part of the cache key for a sheet that comes
+// from its parameters. Others, such as an API key, are left out, so
+// every client shares the cached sheet.
+func sheetCacheKey(q url.Values) string {
+	params := url.Values{}
+	for _, p := range sheetParams {
+		if v, ok := q[p]; ok {
+			params[p] = v
+		}
+	}
+	return Hash(params.Encode())
+}
+
+// intParam parses s, falling back to def if it is missing or
+// outside min and max.
+func intParam(s string, def, min, max int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return def
+	}
+	return n
+}
+
+// sheetLayoutHandler gets the size of a contact sheet and the
+// coordinates of each cell.
+func (s server) sheetLayoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	cells, opts, err := sheetRequest(r)
+	if err != nil {
+		s.responderr(ctx, w, r, http.StatusBadRequest, err)
+		return
+	}
+	bounds, layout := opts.Layout(len(cells))
+	for i := range cells {
+		cells[i].SheetCell = layout[i]
+	}
+	s.respond(ctx, w, r, http.StatusOK, sheetResponse{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Cells:  cells,
+	})
+}
+
+// sheetHandler draws a contact sheet as a PNG.
+func (s server) sheetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	cells, opts, err := sheetRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var private bool
+	for _, cell := range cells {
+		// packs were checked by sheetRequest
+		pack, _ := ImagesPack(cell.Images, "")
+		p, err := s.checkPack(ctx, r, pack)
+		if err == ErrPrivatePack {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Errorf(ctx, "check pack: %s", err)
+			http.Error(w, "Failed to render image :(", http.StatusInternalServerError)
+			return
+		}
+		private = private || p
+	}
+	if private {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	client, ok := s.client(ctx, w, r)
+	if !ok {
+		return
+	}
+	cacheKey := "sheet:" + renderGeneration(ctx) + ":" + sheetCacheKey(r.URL.Query())
+	if cacheItem, err := memcache.Get(ctx, cacheKey); err == nil && !private {
+		log.Debugf(ctx, "cache hit: sheet")
+		s.respondWithPng(ctx, w, r, cacheItem.Value)
+		return
+	}
+	if !s.take(ctx, w, client, len(cells)) {
+		return
+	}
+	images := make([]image.Image, len(cells))
+	var gopherObjects []string
+	for _, cell := range cells {
+		if cell.Gopher != "" {
+			gopherObjects = append(gopherObjects, GopherObject(cell.Gopher))
+		}
+	}
+	gophers, err := LoadImages(ctx, gopherObjects...)
+	if err != nil {
+		log.Errorf(ctx, "load gophers: %s", err)
+		http.Error(w, "Failed to render image :(", http.StatusInternalServerError)
+		return
+	}
+	// gopher cells come first
+	copy(images, gophers)
+	for i, cell := range cells {
+		if cell.Gopher != "" {
+			continue
+		}
+		img, err := RenderImage(ctx, cell.Images, RenderOptions{})
+		if err != nil {
+			log.Warningf(ctx, "render cell %d: %s", i, err)
+			continue
+		}
+		images[i] = img
+	}
+	var buf bytes.Buffer
+	if _, err := EncodeSheet(&buf, images, opts); err != nil {
+		log.Errorf(ctx, "sheet: %s", err)
+		http.Error(w, "Failed to render image :(", http.StatusInternalServerError)
+		return
+	}
+	s.respondWithPng(ctx, w, r, buf.Bytes())
+	if private {
+		return
+	}
+	cacheItem := &memcache.Item{
+		Key:   cacheKey,
+		Value: buf.Bytes(),
+	}
+	if err := memcache.Set(ctx, cacheItem); err != nil {
+		log.Warningf(ctx, "memcache set: %s", err)
+	}
+}
+
+// Hash gets the hex SHA-1 of s. Gophers are keyed by the Hash of their
+// images joined with "|".
+func Hash(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"image"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSheetLayout(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   SheetOptions
+		n      int
+		bounds image.Rectangle
+		cells  []SheetCell
+	}{
+		{
+			name:   "one row",
+			opts:   SheetOptions{Columns: 4, CellSize: 100, Gutter: 10},
+			n:      2,
+			bounds: image.Rect(0, 0, 230, 120),
+			cells:  []SheetCell{{X: 10, Y: 10, Width: 100, Height: 100}, {X: 120, Y: 10, Width: 100, Height: 100}},
+		},
+		{
+			name:   "wraps",
+			opts:   SheetOptions{Columns: 2, CellSize: 50},
+			n:      3,
+			bounds: image.Rect(0, 0, 100, 100),
+			cells: []SheetCell{
+				{X: 0, Y: 0, Width: 50, Height: 50},
+				{X: 50, Y: 0, Width: 50, Height: 50},
+				{X: 0, Y: 50, Width: 50, Height: 50},
+			},
+		},
+		{
+			name:   "labels make rows taller",
+			opts:   SheetOptions{Columns: 1, CellSize: 40, Gutter: 5, Labels: []string{"Mat"}, FontSize: 10},
+			n:      2,
+			bounds: image.Rect(0, 0, 50, 5+2*(40+15+5)),
+			cells: []SheetCell{
+				{X: 5, Y: 5, Width: 40, Height: 40, Label: "Mat"},
+				{X: 5, Y: 65, Width: 40, Height: 40},
+			},
+		},
+		{
+			name:   "no columns is one",
+			opts:   SheetOptions{CellSize: 10, Gutter: 1},
+			n:      2,
+			bounds: image.Rect(0, 0, 12, 23),
+			cells:  []SheetCell{{X: 1, Y: 1, Width: 10, Height: 10}, {X: 1, Y: 12, Width: 10, Height: 10}},
+		},
+		{
+			name:   "empty",
+			opts:   SheetOptions{Columns: 3, CellSize: 10, Gutter: 2},
+			n:      0,
+			bounds: image.Rect(0, 0, 14, 2),
+			cells:  []SheetCell{},
+		},
+	}
+	for _, test := range tests {
+		bounds, cells := test.opts.Layout(test.n)
+		if bounds != test.bounds {
+			t.Errorf("%s: got bounds %v, want %v", test.name, bounds, test.bounds)
+		}
+		if !reflect.DeepEqual(cells, test.cells) {
+			t.Errorf("%s: got cells %+v, want %+v", test.name, cells, test.cells)
+		}
+	}
+}
+
+func TestSheetCacheKey(t *testing.T) {
+	q := url.Values{
+		"images": {"artwork/010-Body/blue_gopher.png|artwork/020-Eyes/crazy_eyes.png"},
+		"cols":   {"3"},
+		"label":  {"Mat", "David"},
+	}
+	key := sheetCacheKey(q)
+	same := url.Values{}
+	for k, v := range q {
+		same[k] = v
+	}
+	same.Set("key", "0123456789ab.0123456789abcdef0123456789abcdef")
+	same.Set("sig", "abc")
+	same.Set("kid", "0123456789ab")
+	same.Set("expires", "1900000000")
+	same.Set("dl", "1")
+	if got := sheetCacheKey(same); got != key {
+		t.Errorf("with an API key and signature: got %s, want %s", got, key)
+	}
+	for _, p := range sheetParams {
+		changed := url.Values{}
+		for k, v := range q {
+			changed[k] = v
+		}
+		changed.Add(p, "9")
+		if sheetCacheKey(changed) == key {
+			t.Errorf("changing %s kept the same key", p)
+		}
+	}
+}
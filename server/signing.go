@@ -0,0 +1,233 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	signingKeyKind = "SigningKey"
+	// signingKeyCacheExpiration is how long keys are cached, so how
+	// long retiring one can take on instances that missed the purge.
+	signingKeyCacheExpiration = 10 * time.Minute
+)
+
+// Errors about signed render URLs.
+var (
+	ErrBadSignature       = errors.New("invalid signature")
+	ErrExpiredSignature   = errors.New("signed URL has expired")
+	ErrSigningKeyNotFound = errors.New("no such signing key")
+)
+
+// formatPaths are the render API paths for each format.
+var formatPaths = map[string]string{
+	FormatPNG:  "/api/render.png",
+	FormatGIF:  "/api/render.gif",
+	FormatAPNG: "/api/render.apng",
+	FormatSVG:  "/api/render.svg",
+}
+
+// SigningKey signs render URLs. The newest key that isn't retired
+// signs new URLs; older ones still verify theirs until they are
+// retired, so keys can be rotated without breaking links.
+type SigningKey struct {
+	ID      string    `datastore:"-" json:"id"`
+	Secret  []byte    `datastore:",noindex" json:"-"`
+	CTime   time.Time `json:"ctime"`
+	Retired bool      `json:"retired"`
+}
+
+// SignRenderURL gets a render API URL for exactly this selection,
+// options and format that works until expires. Signed URLs skip the
+// rate limits and may render private packs, so only sign what you mean
+// to hand out.
+func SignRenderURL(ctx context.Context, format string, images []string, opts RenderOptions, expires time.Time) (string, error) {
+	path, ok := formatPaths[format]
+	if !ok {
+		return "", errors.Errorf("unsupported format %q", format)
+	}
+	k, err := currentSigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return path + "?" + signRenderQuery(k, format, images, opts, expires).Encode(), nil
+}
+
+// signRenderQuery gets the parameters of a render URL signed with k.
+func signRenderQuery(k SigningKey, format string, images []string, opts RenderOptions, expires time.Time) url.Values {
+	q := opts.Encode()
+	q.Set("images", strings.Join(images, "|"))
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("kid", k.ID)
+	q.Set("sig", signature(k.Secret, format, q))
+	return q
+}
+
+// verifySignature checks the signature of a render request. Only the
+// parameters that change the render are signed, so others like dl may
+// be changed.
+func verifySignature(ctx context.Context, format string, q url.Values, opts RenderOptions) error {
+	k, err := loadSigningKey(ctx, q.Get("kid"))
+	if err == ErrSigningKeyNotFound {
+		return ErrBadSignature
+	}
+	if err != nil {
+		return err
+	}
+	return checkSignature(k, format, q, opts, time.Now())
+}
+
+// checkSignature checks q was signed by k for the format and options,
+// and hadn't expired by now.
+func checkSignature(k SigningKey, format string, q url.Values, opts RenderOptions, now time.Time) error {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if k.Retired || q.Get("kid") != k.ID {
+		return ErrBadSignature
+	}
+	signed := opts.Encode()
+	for _, param := range []string{"images", "expires", "kid"} {
+		signed.Set(param, q.Get(param))
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(signature(k.Secret, format, signed))) {
+		return ErrBadSignature
+	}
+	if now.Unix() > expires {
+		return ErrExpiredSignature
+	}
+	return nil
+}
+
+// signature gets the HMAC of the format and the parameters, besides
+// sig itself.
+func signature(secret []byte, format string, q url.Values) string {
+	signed := url.Values{}
+	for k, v := range q {
+		if k != "sig" {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(format + "\n" + signed.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SigningKeys gets every signing key, newest first.
+func SigningKeys(ctx context.Context) ([]SigningKey, error) {
+	var keys []SigningKey
+	dskeys, err := datastore.NewQuery(signingKeyKind).Order("-CTime").GetAll(ctx, &keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "load SigningKeys")
+	}
+	for i := range keys {
+		keys[i].ID = dskeys[i].StringID()
+	}
+	return keys, nil
+}
+
+// RotateSigningKey makes a new key to sign URLs with. URLs signed with
+// older keys keep working until those keys are retired.
+func RotateSigningKey(ctx context.Context) (SigningKey, error) {
+	k := SigningKey{
+		Secret: make([]byte, 32),
+		CTime:  time.Now(),
+	}
+	if _, err := rand.Read(k.Secret); err != nil {
+		return k, errors.Wrap(err, "make signing key")
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return k, errors.Wrap(err, "make signing key")
+	}
+	k.ID = hex.EncodeToString(id)
+	if _, err := datastore.Put(ctx, datastore.NewKey(ctx, signingKeyKind, k.ID, 0, nil), &k); err != nil {
+		return k, errors.Wrap(err, "put SigningKey")
+	}
+	return k, nil
+}
+
+// RetireSigningKey stops URLs signed with the key working.
+func RetireSigningKey(ctx context.Context, id string) error {
+	key := datastore.NewKey(ctx, signingKeyKind, id, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var k SigningKey
+		if err := datastore.Get(ctx, key, &k); err != nil {
+			return err
+		}
+		k.Retired = true
+		_, err := datastore.Put(ctx, key, &k)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrSigningKeyNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "retire SigningKey")
+	}
+	if err := memcache.Delete(ctx, signingKeyCacheKey(id)); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "memcache delete: %s", err)
+	}
+	return nil
+}
+
+// currentSigningKey gets the newest key that isn't retired, making
+// the first one if there are none.
+func currentSigningKey(ctx context.Context) (SigningKey, error) {
+	keys, err := SigningKeys(ctx)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	for _, k := range keys {
+		if !k.Retired {
+			return k, nil
+		}
+	}
+	return RotateSigningKey(ctx)
+}
+
+func signingKeyCacheKey(id string) string {
+	return "signingkey:" + id
+}
+
+func loadSigningKey(ctx context.Context, id string) (SigningKey, error) {
+	var k SigningKey
+	if id == "" {
+		return k, ErrSigningKeyNotFound
+	}
+	if _, err := memcache.Gob.Get(ctx, signingKeyCacheKey(id), &k); err == nil {
+		k.ID = id
+		return k, nil
+	}
+	err := datastore.Get(ctx, datastore.NewKey(ctx, signingKeyKind, id, 0, nil), &k)
+	if err == datastore.ErrNoSuchEntity {
+		return k, ErrSigningKeyNotFound
+	}
+	if err != nil {
+		return k, errors.Wrap(err, "load SigningKey")
+	}
+	k.ID = id
+	item := &memcache.Item{
+		Key:        signingKeyCacheKey(id),
+		Object:     k,
+		Expiration: signingKeyCacheExpiration,
+	}
+	if err := memcache.Gob.Set(ctx, item); err != nil {
+		log.Warningf(ctx, "memcache set: %s", err)
+	}
+	return k, nil
+}
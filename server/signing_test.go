@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckSignature(t *testing.T) {
+	key := SigningKey{ID: "0123456789ab", Secret: []byte("first secret")}
+	rotated := SigningKey{ID: "ba9876543210", Secret: []byte("second secret")}
+	now := time.Date(2017, 12, 24, 12, 0, 0, 0, time.UTC)
+	images := []string{"artwork/010-Body/blue_gopher.png", "artwork/020-Eyes/crazy_eyes.png"}
+	opts, err := ParseRenderOptions(url.Values{"size": {"300"}, "text": {"Mat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		key    SigningKey
+		format string
+		change func(q url.Values)
+		now    time.Time
+		want   error
+	}{
+		{name: "valid", key: key, format: FormatPNG, now: now},
+		{name: "unsigned params may change", key: key, format: FormatPNG, now: now, change: func(q url.Values) {
+			q.Set("dl", "1")
+		}},
+		{name: "at expiry", key: key, format: FormatPNG, now: now.Add(time.Hour)},
+		{name: "expired", key: key, format: FormatPNG, now: now.Add(time.Hour + time.Second), want: ErrExpiredSignature},
+		{name: "other format", key: key, format: FormatGIF, now: now, want: ErrBadSignature},
+		{name: "other key", key: rotated, format: FormatPNG, now: now, want: ErrBadSignature},
+		{name: "retired key", key: SigningKey{ID: key.ID, Secret: key.Secret, Retired: true}, format: FormatPNG, now: now, want: ErrBadSignature},
+		{name: "tampered images", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Set("images", "artwork/010-Body/blue_gopher.png")
+		}},
+		{name: "tampered option", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Set("size", "4000")
+		}},
+		{name: "added option", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Set("say", "hello")
+		}},
+		{name: "removed option", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Del("text")
+		}},
+		{name: "extended expiry", key: key, format: FormatPNG, now: now.Add(2 * time.Hour), want: ErrBadSignature, change: func(q url.Values) {
+			q.Set("expires", "1900000000")
+		}},
+		{name: "bad expiry", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Set("expires", "soon")
+		}},
+		{name: "tampered signature", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Set("sig", q.Get("sig")[1:])
+		}},
+		{name: "no signature", key: key, format: FormatPNG, now: now, want: ErrBadSignature, change: func(q url.Values) {
+			q.Del("sig")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed := signRenderQuery(key, FormatPNG, images, opts, now.Add(time.Hour))
+			// as the render handler gets it
+			q, err := url.ParseQuery(signed.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.change != nil {
+				test.change(q)
+			}
+			got, err := ParseRenderOptions(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkSignature(test.key, test.format, q, got, test.now); err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSignRenderQueryRotation(t *testing.T) {
+	first := SigningKey{ID: "0123456789ab", Secret: []byte("first secret")}
+	second := SigningKey{ID: "ba9876543210", Secret: []byte("second secret")}
+	now := time.Now()
+	images := []string{"artwork/010-Body/blue_gopher.png"}
+	a := signRenderQuery(first, FormatPNG, images, RenderOptions{}, now.Add(time.Hour))
+	b := signRenderQuery(second, FormatPNG, images, RenderOptions{}, now.Add(time.Hour))
+	if a.Get("kid") != first.ID || b.Get("kid") != second.ID {
+		t.Fatalf("kid: got %q and %q", a.Get("kid"), b.Get("kid"))
+	}
+	if a.Get("sig") == b.Get("sig") {
+		t.Error("different keys gave the same signature")
+	}
+	// URLs signed before a rotation keep working with their own key
+	for _, c := range []struct {
+		q url.Values
+		k SigningKey
+	}{{a, first}, {b, second}} {
+		if err := checkSignature(c.k, FormatPNG, c.q, RenderOptions{}, now); err != nil {
+			t.Errorf("kid %s: %v", c.k.ID, err)
+		}
+	}
+}
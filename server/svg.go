@@ -0,0 +1,413 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/net/context"
+)
+
+const (
+	// svgContentType is the content type of vector artwork.
+	svgContentType = "image/svg+xml"
+	// minRenderSize and maxRenderSize limit the size option.
+	minRenderSize = 16
+	maxRenderSize = 4096
+)
+
+// ErrNotVector is returned by RenderSVG when a chosen item is not an
+// SVG.
+var ErrNotVector = errors.New("vector output needs every item to be an SVG")
+
+func init() {
+	// SVG artwork decodes with image.Decode like the PNGs do
+	image.RegisterFormat("svg", "<svg", decodeSVG, decodeSVGConfig)
+	image.RegisterFormat("svg", "<?xml", decodeSVG, decodeSVGConfig)
+}
+
+// vectorImage is an SVG. It is an image rasterised at its natural size,
+// and keeps its source so it can be drawn crisply at any other size.
+type vectorImage struct {
+	*image.RGBA
+	src  []byte
+	icon *oksvg.SvgIcon
+}
+
+func decodeSVG(r io.Reader) (image.Image, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(src), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, errors.Wrap(err, "read svg")
+	}
+	w, h := int(math.Ceil(icon.ViewBox.W)), int(math.Ceil(icon.ViewBox.H))
+	if w < 1 || h < 1 || w > maxRenderSize || h > maxRenderSize {
+		return nil, errors.New("svg needs a viewBox or width and height")
+	}
+	v := &vectorImage{src: src, icon: icon}
+	v.RGBA = v.rasterise(image.Rect(0, 0, w, h))
+	return v, nil
+}
+
+// decodeSVGConfig reads the size of an SVG from its root element
+// without drawing it, as image.DecodeConfig may be given anything.
+func decodeSVGConfig(r io.Reader) (image.Config, error) {
+	w, h, err := svgSize(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: w, Height: h}, nil
+}
+
+// svgSize gets the natural size of an SVG the way oksvg works it out:
+// the size of the root element's viewBox, or else its width and height.
+func svgSize(r io.Reader) (int, int, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "read svg")
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if el.Name.Local != "svg" {
+			return 0, 0, errors.New("root element must be svg")
+		}
+		var viewW, viewH, width, height float64
+		for _, a := range el.Attr {
+			switch a.Name.Local {
+			case "viewBox":
+				f := strings.FieldsFunc(a.Value, func(r rune) bool { return r == ',' || r == ' ' })
+				if len(f) != 4 {
+					return 0, 0, errors.New("viewBox must have four numbers")
+				}
+				if viewW, err = strconv.ParseFloat(f[2], 64); err == nil {
+					viewH, err = strconv.ParseFloat(f[3], 64)
+				}
+			case "width":
+				width, err = parseLength(a.Value)
+			case "height":
+				height, err = parseLength(a.Value)
+			}
+			if err != nil {
+				return 0, 0, errors.Wrap(err, "read svg")
+			}
+		}
+		if viewW == 0 {
+			viewW = width
+		}
+		if viewH == 0 {
+			viewH = height
+		}
+		w, h := int(math.Ceil(viewW)), int(math.Ceil(viewH))
+		if w < 1 || h < 1 || w > maxRenderSize || h > maxRenderSize {
+			return 0, 0, errors.New("svg needs a viewBox or width and height")
+		}
+		return w, h, nil
+	}
+}
+
+// parseLength parses an SVG length, ignoring its unit.
+func parseLength(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimRightFunc(s, unicode.IsLetter), 64)
+}
+
+// rasterise draws the SVG scaled to fill r.
+func (v *vectorImage) rasterise(r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r)
+	w, h := r.Dx(), r.Dy()
+	v.icon.SetTarget(float64(r.Min.X), float64(r.Min.Y), float64(w), float64(h))
+	scanner := rasterx.NewScannerGV(w, h, img, r)
+	v.icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img
+}
+
+// resizeLayers scales every frame to fill a canvas width pixels wide.
+// SVGs are rasterised at the new size; other images are resampled.
+func resizeLayers(canvas image.Rectangle, layers []layer, width int) (image.Rectangle, []layer) {
+	if canvas.Empty() {
+		return canvas, layers
+	}
+	target := image.Rect(0, 0, width, width*canvas.Dy()/canvas.Dx())
+	resized := make([]layer, len(layers))
+	for i, l := range layers {
+		frames := make(layer, len(l))
+		for f, frame := range l {
+			if v, ok := frame.(*vectorImage); ok {
+				frames[f] = v.rasterise(target)
+				continue
+			}
+			if frame.Bounds().Size() == target.Size() {
+				frames[f] = frame
+				continue
+			}
+			img := image.NewRGBA(target)
+			xdraw.CatmullRom.Scale(img, target, frame, frame.Bounds(), xdraw.Over, nil)
+			frames[f] = img
+		}
+		resized[i] = frames
+	}
+	return target, resized
+}
+
+// RenderSVG stacks the images into a single SVG document. Every item
+// must be an SVG, otherwise ErrNotVector is returned.
+// Text and overlays are only available for raster renders.
+func RenderSVG(ctx context.Context, w io.Writer, images []string, opts RenderOptions) error {
+	if opts.Text != nil || len(opts.Overlays) > 0 {
+		return errors.New("text and overlays need a raster render")
+	}
+	imgObjects, err := LoadImages(ctx, images...)
+	if err != nil {
+		return err
+	}
+	var vectors []*vectorImage
+	for _, img := range imgObjects {
+		if img == nil {
+			continue
+		}
+		v, ok := img.(*vectorImage)
+		if !ok {
+			return ErrNotVector
+		}
+		vectors = append(vectors, v)
+	}
+	if len(vectors) == 0 {
+		return errors.New("Artwork is being updated - please try again later")
+	}
+	canvas := vectors[0].Bounds()
+	width, height := canvas.Dx(), canvas.Dy()
+	if w := opts.width(canvas); w != width {
+		width, height = w, w*canvas.Dy()/canvas.Dx()
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		width, height, canvas.Dx(), canvas.Dy())
+	for i, v := range vectors {
+		if err := writeSVGLayer(&buf, v, canvas, fmt.Sprintf("l%d-", i)); err != nil {
+			return errors.Wrapf(err, "layer %d", i)
+		}
+	}
+	buf.WriteString("</svg>\n")
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+var svgRefPattern = regexp.MustCompile(`url\(\s*#`)
+
+// svgElements are the elements SVG artwork may use. Anything else, like
+// script or foreignObject, is refused by CheckSVG and dropped from
+// renders along with its content.
+var svgElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "symbol": true, "use": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true,
+	"line": true, "polyline": true, "polygon": true,
+	"text": true, "tspan": true, "style": true,
+	"linearGradient": true, "radialGradient": true, "stop": true,
+	"clipPath": true, "mask": true, "pattern": true,
+	"title": true, "desc": true, "metadata": true,
+}
+
+// svgAttributes are the attributes SVG artwork may use, besides
+// namespace declarations and href (which must point inside the file).
+var svgAttributes = map[string]bool{
+	"id": true, "class": true, "style": true, "transform": true,
+	"version": true, "viewBox": true, "preserveAspectRatio": true,
+	"x": true, "y": true, "width": true, "height": true,
+	"x1": true, "y1": true, "x2": true, "y2": true,
+	"cx": true, "cy": true, "r": true, "rx": true, "ry": true,
+	"fx": true, "fy": true, "dx": true, "dy": true,
+	"d": true, "points": true, "offset": true,
+	"fill": true, "fill-opacity": true, "fill-rule": true,
+	"stroke": true, "stroke-width": true, "stroke-opacity": true,
+	"stroke-linecap": true, "stroke-linejoin": true, "stroke-miterlimit": true,
+	"stroke-dasharray": true, "stroke-dashoffset": true,
+	"opacity": true, "color": true, "display": true, "visibility": true,
+	"overflow": true, "vector-effect": true, "mix-blend-mode": true,
+	"stop-color": true, "stop-opacity": true,
+	"gradientUnits": true, "gradientTransform": true, "spreadMethod": true,
+	"clip-path": true, "clip-rule": true, "clipPathUnits": true,
+	"mask": true, "maskUnits": true, "maskContentUnits": true,
+	"patternUnits": true, "patternContentUnits": true, "patternTransform": true,
+	"font-family": true, "font-size": true, "font-weight": true,
+	"font-style": true, "text-anchor": true, "dominant-baseline": true,
+	"letter-spacing": true,
+}
+
+// svgExternalPattern matches CSS that loads something from outside the
+// file.
+var svgExternalPattern = regexp.MustCompile(`(?i)@import|url\(\s*['"]?\s*[^#'"\s]`)
+
+func svgElementAllowed(n xml.Name) bool {
+	return n.Space == "" && svgElements[n.Local]
+}
+
+func svgAttrAllowed(a xml.Attr) bool {
+	switch {
+	case a.Name.Space == "xmlns", a.Name.Space == "" && a.Name.Local == "xmlns":
+		return true
+	case a.Name.Space == "xml" && a.Name.Local == "space":
+		return true
+	case a.Name.Local == "href" && (a.Name.Space == "" || a.Name.Space == "xlink"):
+		return strings.HasPrefix(a.Value, "#")
+	case a.Name.Space != "":
+		return false
+	}
+	return svgAttributes[a.Name.Local] && !svgExternalPattern.MatchString(a.Value)
+}
+
+// CheckSVG checks an SVG only uses the elements and attributes in
+// svgElements and svgAttributes, and refers to nothing outside itself.
+// What is inside metadata isn't checked, as it is never rendered.
+func CheckSVG(src []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(src))
+	dec.Strict = false
+	metadata := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read svg")
+		}
+		if metadata > 0 {
+			switch tok.(type) {
+			case xml.StartElement:
+				metadata++
+			case xml.EndElement:
+				metadata--
+			}
+			continue
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space == "" && t.Name.Local == "metadata" {
+				metadata++
+				continue
+			}
+			if !svgElementAllowed(t.Name) {
+				return errors.Errorf("SVGs may not use <%s> - save it as a plain SVG", qname(t.Name))
+			}
+			for _, a := range t.Attr {
+				if !svgAttrAllowed(a) {
+					return errors.Errorf("SVGs may not use the %s attribute on <%s> - save it as a plain SVG", qname(a.Name), qname(t.Name))
+				}
+			}
+		case xml.CharData:
+			if svgExternalPattern.Match(t) {
+				return errors.New("SVG styles may not load anything from outside the file")
+			}
+		}
+	}
+}
+
+// writeSVGLayer writes the SVG as a nested svg element filling canvas.
+// IDs are prefixed so those in different layers don't clash. Elements
+// and attributes CheckSVG would refuse are left out, in case the
+// artwork was put in the bucket some other way.
+func writeSVGLayer(w *bytes.Buffer, v *vectorImage, canvas image.Rectangle, prefix string) error {
+	dec := xml.NewDecoder(bytes.NewReader(v.src))
+	dec.Strict = false
+	root := true
+	// skip is how deep we are in an element being left out
+	skip := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read svg")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skip > 0 || !svgElementAllowed(t.Name) || t.Name.Local == "metadata" {
+				skip++
+				continue
+			}
+			attrs := t.Attr[:0]
+			hasViewBox := false
+			for _, a := range t.Attr {
+				if !svgAttrAllowed(a) {
+					continue
+				}
+				if root && a.Name.Space == "" {
+					switch a.Name.Local {
+					case "x", "y", "width", "height":
+						continue
+					case "viewBox":
+						hasViewBox = true
+					}
+				}
+				switch {
+				case a.Name.Local == "id":
+					a.Value = prefix + a.Value
+				case a.Name.Local == "href" && strings.HasPrefix(a.Value, "#"):
+					a.Value = "#" + prefix + a.Value[1:]
+				default:
+					a.Value = svgRefPattern.ReplaceAllString(a.Value, "url(#"+prefix)
+				}
+				attrs = append(attrs, a)
+			}
+			if root {
+				attrs = append(attrs,
+					xml.Attr{Name: xml.Name{Local: "x"}, Value: "0"},
+					xml.Attr{Name: xml.Name{Local: "y"}, Value: "0"},
+					xml.Attr{Name: xml.Name{Local: "width"}, Value: fmt.Sprint(canvas.Dx())},
+					xml.Attr{Name: xml.Name{Local: "height"}, Value: fmt.Sprint(canvas.Dy())},
+				)
+				if !hasViewBox {
+					b := v.Bounds()
+					attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "viewBox"}, Value: fmt.Sprintf("0 0 %d %d", b.Dx(), b.Dy())})
+				}
+				root = false
+			}
+			w.WriteString("<" + qname(t.Name))
+			for _, a := range attrs {
+				w.WriteString(" " + qname(a.Name) + `="`)
+				xml.EscapeText(w, []byte(a.Value))
+				w.WriteString(`"`)
+			}
+			w.WriteString(">")
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			w.WriteString("</" + qname(t.Name) + ">")
+		case xml.CharData:
+			if skip > 0 || svgExternalPattern.Match(t) {
+				continue
+			}
+			// stylesheets may refer to IDs too
+			xml.EscapeText(w, svgRefPattern.ReplaceAll(t, []byte("url(#"+prefix)))
+		}
+		// comments, processing instructions and doctypes are dropped
+	}
+}
+
+func qname(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
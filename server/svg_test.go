@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"strings"
+	"testing"
+)
+
+func TestCheckSVG(t *testing.T) {
+	tests := []struct {
+		name string
+		svg  string
+		ok   bool
+	}{
+		{"plain", `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><path d="M0 0L10 10" fill="#fff"/></svg>`, true},
+		{"xml declaration", `<?xml version="1.0"?><svg viewBox="0 0 10 10"><rect width="10" height="10"/></svg>`, true},
+		{"local href", `<svg xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10"><defs><circle id="c" r="2"/></defs><use xlink:href="#c"/></svg>`, true},
+		{"local url", `<svg viewBox="0 0 10 10"><rect fill="url(#g)" width="10" height="10"/></svg>`, true},
+		{"anything in metadata", `<svg viewBox="0 0 10 10"><metadata><rdf:RDF><script>x</script></rdf:RDF></metadata></svg>`, true},
+		{"script", `<svg viewBox="0 0 10 10"><script>alert(1)</script></svg>`, false},
+		{"prefixed script", `<svg:svg xmlns:svg="http://www.w3.org/2000/svg"><svg:script>alert(1)</svg:script></svg:svg>`, false},
+		{"foreignObject", `<svg viewBox="0 0 10 10"><foreignObject><div/></foreignObject></svg>`, false},
+		{"image", `<svg viewBox="0 0 10 10"><image href="#x"/></svg>`, false},
+		{"event handler", `<svg viewBox="0 0 10 10" onload="alert(1)"></svg>`, false},
+		{"external href", `<svg viewBox="0 0 10 10"><use href="https://example.com/a.svg#c"/></svg>`, false},
+		{"external xlink:href", `<svg xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10"><use xlink:href="other.svg#c"/></svg>`, false},
+		{"external url", `<svg viewBox="0 0 10 10"><rect fill="url(https://example.com/p.svg#g)"/></svg>`, false},
+		{"external style", `<svg viewBox="0 0 10 10"><rect style="fill: url('a.png')"/></svg>`, false},
+		{"style import", `<svg viewBox="0 0 10 10"><style>@import "https://example.com/a.css";</style></svg>`, false},
+		{"not XML", `<svg viewBox="0 0 10 10"><rect`, false},
+	}
+	for _, test := range tests {
+		err := CheckSVG([]byte(test.svg))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestWriteSVGLayerDropsUnsafe(t *testing.T) {
+	src := `<svg viewBox="0 0 10 10" onload="alert(1)"><script>alert(2)</script><foreignObject><div>hi</div></foreignObject><rect id="r" width="10" height="10"/></svg>`
+	img, err := decodeSVG(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeSVGLayer(&buf, img.(*vectorImage), image.Rect(0, 0, 10, 10), "l0-"); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{"script", "alert", "foreignObject", "div"} {
+		if strings.Contains(out, s) {
+			t.Errorf("layer still has %q: %s", s, out)
+		}
+	}
+	if !strings.Contains(out, "<rect") {
+		t.Errorf("layer lost its rect: %s", out)
+	}
+}
+
+func TestSVGSize(t *testing.T) {
+	tests := []struct {
+		svg  string
+		w, h int
+		ok   bool
+	}{
+		{`<svg viewBox="0 0 300 200"/>`, 300, 200, true},
+		{`<svg viewBox="0,0,300.5,200"/>`, 301, 200, true},
+		{`<?xml version="1.0"?><!-- art --><svg width="64px" height="32"/>`, 64, 32, true},
+		// the viewBox wins, as it does when drawing
+		{`<svg width="600" height="400" viewBox="0 0 300 200"/>`, 300, 200, true},
+		{`<svg/>`, 0, 0, false},
+		{`<svg viewBox="0 0 300"/>`, 0, 0, false},
+		{`<svg width="wide" height="10"/>`, 0, 0, false},
+		{`<svg width="100000" height="10"/>`, 0, 0, false},
+		{`<html><svg viewBox="0 0 10 10"/></html>`, 0, 0, false},
+	}
+	for _, test := range tests {
+		w, h, err := svgSize(strings.NewReader(test.svg))
+		if (err == nil) != test.ok || w != test.w || h != test.h {
+			t.Errorf("%s: got %dx%d, %v, want %dx%d, ok %v", test.svg, w, h, err, test.w, test.h, test.ok)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Limits on text drawn onto renders.
+const (
+	maxTextLen     = 40
+	minTextSize    = 8
+	maxTextSize    = 200
+	maxTextOutline = 10
+)
+
+// Text positions.
+const (
+	// TextTop draws text over the top of the gopher.
+	TextTop = "top"
+	// TextBottom draws text over the bottom of the gopher.
+	TextBottom = "bottom"
+	// TextBelow adds a band under the gopher for the text, like a
+	// name badge.
+	TextBelow = "below"
+)
+
+// TextOptions describe text drawn onto a render with the bundled Go
+// font.
+type TextOptions struct {
+	Text     string
+	Position string
+	// Size is the font size in pixels. Text is shrunk to fit the
+	// width of the image.
+	Size         float64
+	Color        color.Color
+	Outline      int
+	OutlineColor color.Color
+}
+
+// cleanRenderText checks s is valid UTF-8 of at most max characters,
+// turning whitespace into plain spaces and dropping other control and
+// formatting characters.
+func cleanRenderText(s string, max int) (string, error) {
+	if !utf8.ValidString(s) {
+		return "", errors.New("text must be valid UTF-8")
+	}
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) > max {
+		return "", errors.Errorf("text must be %d characters or fewer", max)
+	}
+	return s, nil
+}
+
+// parseColor parses a hex colour like #rrggbb, rrggbb or rrggbbaa.
+func parseColor(s string) (color.Color, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 && len(s) != 8 {
+		return nil, errors.Errorf("bad colour %q", s)
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, errors.Errorf("bad colour %q", s)
+	}
+	c := color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}
+	return c, nil
+}
+
+// DrawText draws the text onto img, returning a taller image if the
+// text goes below it.
+func DrawText(img *image.RGBA, opts TextOptions) (*image.RGBA, error) {
+	if opts.Text == "" {
+		return img, nil
+	}
+	b := img.Bounds()
+	size := opts.Size
+	face, err := fontFace(size)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(withGlyphs(opts.Text))
+	if text == "" {
+		face.Close()
+		return img, nil
+	}
+	// shrink the text to fit the width
+	margin := fixed.I(opts.Outline*2 + b.Dx()/20)
+	for size > minTextSize && font.MeasureString(face, text)+margin > fixed.I(b.Dx()) {
+		face.Close()
+		size = size * 0.9
+		if face, err = fontFace(size); err != nil {
+			return nil, err
+		}
+	}
+	defer face.Close()
+	metrics := face.Metrics()
+	lineHeight := (metrics.Ascent + metrics.Descent).Ceil() + opts.Outline*2
+	pad := lineHeight / 4
+	dst := img
+	var baseline int
+	switch opts.Position {
+	case TextTop:
+		baseline = b.Min.Y + pad + opts.Outline + metrics.Ascent.Ceil()
+	case TextBelow:
+		dst = image.NewRGBA(image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Max.Y+lineHeight+pad*2))
+		draw.Draw(dst, b, img, b.Min, draw.Src)
+		baseline = b.Max.Y + pad + opts.Outline + metrics.Ascent.Ceil()
+	default:
+		baseline = b.Max.Y - pad - opts.Outline - metrics.Descent.Ceil()
+	}
+	width := font.MeasureString(face, text)
+	dot := fixed.Point26_6{
+		X: fixed.I(b.Min.X) + (fixed.I(b.Dx())-width)/2,
+		Y: fixed.I(baseline),
+	}
+	d := &font.Drawer{Dst: dst, Face: face}
+	if opts.Outline > 0 {
+		// draw the shape of the text once, and grow it into the outline
+		r := opts.Outline
+		bounds, _ := font.BoundString(face, text)
+		rect := image.Rect(
+			(dot.X + bounds.Min.X).Floor(), (dot.Y + bounds.Min.Y).Floor(),
+			(dot.X + bounds.Max.X).Ceil(), (dot.Y + bounds.Max.Y).Ceil(),
+		).Inset(-r)
+		mask := image.NewAlpha(rect)
+		m := &font.Drawer{Dst: mask, Src: image.Opaque, Face: face, Dot: dot}
+		m.DrawString(text)
+		outline := dilate(mask, r)
+		draw.DrawMask(dst, rect, image.NewUniform(opts.OutlineColor), image.Point{}, outline, rect.Min, draw.Over)
+	}
+	d.Src = image.NewUniform(opts.Color)
+	d.Dot = dot
+	d.DrawString(text)
+	return dst, nil
+}
+
+// dilate grows the shape in mask by r pixels: each pixel gets the most
+// alpha within a circle of radius r around it. The circle is a stack of
+// rows, so the most in runs of each half-width is found in turn, each
+// from the one before, and used for the rows of the circle that wide.
+// The work grows with r, where stamping the circle grows with r².
+func dilate(mask *image.Alpha, r int) *image.Alpha {
+	b := mask.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewAlpha(b)
+	// rows[k] are the rows of the circle reaching k pixels either side
+	rows := make([][]int, r+1)
+	for dy := -r; dy <= r; dy++ {
+		k := int(math.Sqrt(float64(r*r - dy*dy)))
+		rows[k] = append(rows[k], dy)
+	}
+	run := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		copy(run[y*w:(y+1)*w], mask.Pix[y*mask.Stride:])
+	}
+	next := make([]uint8, w*h)
+	for k := 0; k <= r; k++ {
+		if k > 0 {
+			// widen the runs by a pixel either side
+			for y := 0; y < h; y++ {
+				from, to := run[y*w:(y+1)*w], next[y*w:(y+1)*w]
+				for x, v := range from {
+					if x > 0 && from[x-1] > v {
+						v = from[x-1]
+					}
+					if x < w-1 && from[x+1] > v {
+						v = from[x+1]
+					}
+					to[x] = v
+				}
+			}
+			run, next = next, run
+		}
+		for _, dy := range rows[k] {
+			for y := 0; y < h; y++ {
+				if y+dy < 0 || y+dy >= h {
+					continue
+				}
+				from, to := run[(y+dy)*w:(y+dy+1)*w], out.Pix[y*out.Stride:]
+				for x, v := range from {
+					if v > to[x] {
+						to[x] = v
+					}
+				}
+			}
+		}
+	}
+	return out
+}
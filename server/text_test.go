@@ -0,0 +1,69 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDilate(t *testing.T) {
+	for _, r := range []int{1, 2, 5, 12} {
+		mask := image.NewAlpha(image.Rect(10, 20, 60, 70))
+		// a few dots, one at the edge, and one fainter
+		dots := map[image.Point]uint8{{30, 40}: 255, {10, 20}: 255, {44, 60}: 100}
+		for p, a := range dots {
+			mask.SetAlpha(p.X, p.Y, color.Alpha{A: a})
+		}
+		got := dilate(mask, r)
+		if got.Bounds() != mask.Bounds() {
+			t.Fatalf("r=%d: got bounds %v, want %v", r, got.Bounds(), mask.Bounds())
+		}
+		// check against stamping the circle
+		b := mask.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				var want uint8
+				for p, a := range dots {
+					dx, dy := x-p.X, y-p.Y
+					if dx*dx+dy*dy <= r*r && a > want {
+						want = a
+					}
+				}
+				if a := got.AlphaAt(x, y).A; a != want {
+					t.Fatalf("r=%d: alpha at %d,%d: got %d, want %d", r, x, y, a, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDrawTextOutline(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	red := color.NRGBA{R: 255, A: 255}
+	out, err := DrawText(img, TextOptions{
+		Text:         "Gopher",
+		Position:     TextBottom,
+		Size:         60,
+		Color:        color.White,
+		Outline:      8,
+		OutlineColor: red,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outline, fill int
+	b := out.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			switch out.RGBAAt(x, y) {
+			case color.RGBA{R: 255, A: 255}:
+				outline++
+			case color.RGBA{R: 255, G: 255, B: 255, A: 255}:
+				fill++
+			}
+		}
+	}
+	if outline == 0 || fill == 0 {
+		t.Errorf("got %d outline and %d text pixels, want both", outline, fill)
+	}
+}
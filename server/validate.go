@@ -0,0 +1,259 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/appengine/memcache"
+)
+
+// catalogReads is how many objects CheckCatalog reads at once.
+const catalogReads = 16
+
+// categoryDirPattern matches the folders categories live in, like
+// 010-Eyes.
+var categoryDirPattern = regexp.MustCompile(`^[0-9]+-[A-Za-z0-9_]{1,40}$`)
+
+// CatalogReport describes a pack's catalog as it is in the bucket, and
+// what breaks the rules in the README. Items that break them are left
+// out of the picker, or render badly.
+type CatalogReport struct {
+	Pack string `json:"pack"`
+	// Version is the version the catalog has in the bucket now, and
+	// CachedVersion the one being served, which is empty if nothing is
+	// cached. They differ until the catalog is refreshed.
+	Version       string `json:"version"`
+	CachedVersion string `json:"cached_version,omitempty"`
+	Private       bool   `json:"private,omitempty"`
+	Categories    int    `json:"categories"`
+	Items         int    `json:"items"`
+	// Problems are the rules the objects break.
+	Problems []CatalogProblem `json:"problems,omitempty"`
+}
+
+// CatalogProblem is a rule an object breaks.
+type CatalogProblem struct {
+	Object  string `json:"object"`
+	Problem string `json:"problem"`
+}
+
+// Packs gets the ID of every pack, starting with the default.
+func Packs(ctx context.Context) ([]string, error) {
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	packs := []string{""}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: packsPrefix, Delimiter: "/"})
+	for {
+		obj, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "list packs")
+		}
+		pack := strings.TrimSuffix(strings.TrimPrefix(obj.Prefix, packsPrefix), "/")
+		if CheckPack(pack) == nil && pack != "" {
+			packs = append(packs, pack)
+		}
+	}
+	sort.Strings(packs[1:])
+	return packs, nil
+}
+
+// CheckCatalog reads the pack's objects from the bucket and checks them
+// against the rules. It reads the start of every item, catalogReads at
+// a time.
+func CheckCatalog(ctx context.Context, pack string) (CatalogReport, error) {
+	report := CatalogReport{Pack: pack}
+	if err := CheckPack(pack); err != nil {
+		return report, err
+	}
+	var cached artworkResponse
+	if _, err := memcache.Gob.Get(ctx, artworkCacheKey(pack), &cached); err == nil {
+		report.CachedVersion = cached.Version
+	}
+	bucket, err := Bucket(ctx)
+	if err != nil {
+		return report, err
+	}
+	prefix := packPrefix(pack)
+	objects, err := listArtwork(ctx, bucket, prefix)
+	if err != nil {
+		return report, errors.Wrap(err, "list artwork")
+	}
+	report.Version = catalogVersion(objects)
+	config, err := readPackConfig(ctx, bucket, pack)
+	if err != nil {
+		return report, err
+	}
+	report.Private = config.Private
+	var collections []Collection
+	if collections, err = readCollections(ctx, bucket, pack); err != nil {
+		return report, err
+	}
+	scheduled := make(map[string]bool)
+	for _, c := range collections {
+		scheduled[c.Name] = true
+	}
+	problem := func(object, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, CatalogProblem{
+			Object:  object,
+			Problem: fmt.Sprintf(format, args...),
+		})
+	}
+
+	names := make(map[string]bool)
+	categoryDirs := make(map[string]string)
+	type item struct {
+		object  *storage.ObjectAttrs
+		factor  int
+		conf    image.Config
+		format  string
+		decoded bool
+	}
+	var items []item
+	for _, object := range objects {
+		names[object.Name] = true
+		if object.Name == prefix+collectionsFile || object.Name == prefix+packConfigFile {
+			continue
+		}
+		if strings.HasSuffix(object.Name, "/") {
+			// folder placeholders
+			continue
+		}
+		if object.ContentType != "image/png" && object.ContentType != svgContentType {
+			problem(object.Name, "must be a PNG or SVG, not %q", object.ContentType)
+			continue
+		}
+		if strings.Count(strings.TrimPrefix(object.Name, prefix), "/") != 1 {
+			problem(object.Name, "must be in a category folder straight under %s", prefix)
+			continue
+		}
+		dir := path.Base(path.Dir(object.Name))
+		if !categoryDirPattern.MatchString(dir) {
+			problem(object.Name, "category folders must be named like 010-Category")
+			continue
+		}
+		category := categoryName(object.Name)
+		if other, ok := categoryDirs[category]; ok && other != dir {
+			problem(object.Name, "category %s is also in %s", category, other)
+		}
+		categoryDirs[category] = dir
+		base := strings.TrimSuffix(path.Base(object.Name), path.Ext(object.Name))
+		factor := 1
+		if isVariant(object.Name) {
+			i := strings.LastIndex(base, "@")
+			factor = map[string]int{"@2x": 2, "@4x": 4}[base[i:]]
+			if factor == 0 {
+				problem(object.Name, "only @2x and @4x variants are used")
+				continue
+			}
+			base = base[:i]
+		}
+		if err := CheckArtworkName(base); err != nil {
+			problem(object.Name, "%s", err)
+		}
+		if factor == 1 {
+			report.Items++
+			if err := CheckState(state(object)); err != nil {
+				problem(object.Name, "%s", err)
+			}
+			if c := object.Metadata["collection"]; c != "" && !scheduled[c] {
+				problem(object.Name, "is in collection %s, which isn't scheduled, so it is never in the picker", c)
+			}
+		}
+		items = append(items, item{object: object, factor: factor})
+	}
+	report.Categories = len(categoryDirs)
+
+	objectNames := make([]string, len(items))
+	for i, entry := range items {
+		objectNames[i] = entry.object.Name
+	}
+	for i, read := range readConfigs(ctx, bucket, objectNames) {
+		if read.err != nil {
+			problem(items[i].object.Name, "can't be read: %s", read.err)
+			continue
+		}
+		items[i].conf, items[i].format, items[i].decoded = read.conf, read.format, true
+	}
+
+	// the canvas is set by the config, or is the narrowest PNG item, as
+	// strips are wider
+	canvas := image.Rect(0, 0, config.Width, config.Height)
+	for _, entry := range items {
+		if config.Width != 0 || !entry.decoded || entry.format != "png" || entry.factor != 1 {
+			continue
+		}
+		if canvas.Empty() || entry.conf.Width < canvas.Dx() {
+			canvas = image.Rect(0, 0, entry.conf.Width, entry.conf.Height)
+		}
+	}
+	for _, entry := range items {
+		name := entry.object.Name
+		if entry.factor != 1 {
+			i := strings.LastIndex(name, "@")
+			if original := name[:i] + path.Ext(name); !names[original] {
+				problem(name, "is a variant of %s, which doesn't exist", path.Base(original))
+			}
+			if entry.format == "svg" {
+				problem(name, "only PNGs have @2x or @4x variants")
+				continue
+			}
+		}
+		if !entry.decoded || canvas.Empty() {
+			continue
+		}
+		if err := checkSize(entry.conf, entry.format, canvas, entry.factor); err != nil {
+			problem(name, "%s", err)
+		}
+	}
+	return report, nil
+}
+
+// objectConfig is what readConfigs read from an object.
+type objectConfig struct {
+	conf   image.Config
+	format string
+	err    error
+}
+
+// readConfigs reads the size and format of the images in the named
+// objects, a few at a time.
+func readConfigs(ctx context.Context, bucket *storage.BucketHandle, names []string) []objectConfig {
+	reads := make([]objectConfig, len(names))
+	sem := make(chan struct{}, catalogReads)
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string, read *objectConfig) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			read.conf, read.format, read.err = readConfig(ctx, bucket, name)
+		}(names[i], &reads[i])
+	}
+	wg.Wait()
+	return reads
+}
+
+// readConfig reads the size and format of the image in the object.
+func readConfig(ctx context.Context, bucket *storage.BucketHandle, name string) (image.Config, string, error) {
+	r, err := bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer r.Close()
+	return image.DecodeConfig(r)
+}